@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnauthorizedKey is returned when a key is not listed in the authorized_keys file.
+var ErrUnauthorizedKey = errors.New("ssh: public key not authorized")
+
+// AuthorizedKeys authenticates users with keys listed in OpenSSH
+// authorized_keys files. Files are read again whenever they change on disk.
+//
+// The following options are supported:
+//
+//	command="cmd"          forces the command, see ForceCommand
+//	environment="N=v"      adds to the session environment, see Environment
+//	expiry-time="time"     refuses the key after YYYYMMDD[HHMM[SS]] local time
+//	from="pattern-list"    restricts the client address
+//	permitopen="host:port" restricts local port forwarding, see PermitOpen
+//	no-port-forwarding, no-pty, no-agent-forwarding, no-X11-forwarding, no-user-rc
+//	restrict, port-forwarding, pty, agent-forwarding, X11-forwarding, user-rc
+//
+// The from option only matches IP addresses and CIDR ranges, host names are not
+// resolved. Keys with unknown options are ignored, as OpenSSH does. The
+// permitted features are added to the ssh.Permissions as permit-* extensions,
+// see Permitted.
+//
+// Authenticate can be used as the Config PublicKeyCallback.
+type AuthorizedKeys struct {
+
+	// Path is the authorized_keys file shared by every user.
+	Path string
+
+	// UserPath, if non-nil, returns the authorized_keys file for a user,
+	// such as filepath.Join("/home", user, ".ssh/authorized_keys"). It is
+	// used instead of the Path. Users with path separators in their name
+	// are refused.
+	UserPath func(user string) string
+
+	// Clock is used to check the expiry-time option. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu    sync.Mutex
+	files map[string]*keyFile
+}
+
+// keyFile holds the parsed entries of an authorized_keys file.
+type keyFile struct {
+	modTime time.Time
+	size    int64
+	entries []*authorizedKey
+}
+
+// authorizedKey is a single authorized_keys entry.
+type authorizedKey struct {
+	key    string
+	from   string
+	expiry time.Time
+	perms  ssh.Permissions
+}
+
+// Authenticate checks the key against the authorized_keys file for the user.
+func (a *AuthorizedKeys) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	path, err := a.path(conn.User())
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := a.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := a.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+
+	data := string(key.Marshal())
+	for _, entry := range file.entries {
+		if entry.key != data {
+			continue
+		}
+		if !entry.expiry.IsZero() && !clock().Before(entry.expiry) {
+			return nil, fmt.Errorf("ssh: authorized key has expired")
+		}
+		if entry.from != "" && !matchFrom(entry.from, conn.RemoteAddr()) {
+			return nil, fmt.Errorf("ssh: authorized key not allowed from %s", conn.RemoteAddr())
+		}
+		return copyPermissions(&entry.perms), nil
+	}
+	return nil, ErrUnauthorizedKey
+}
+
+// path returns the authorized_keys file for the user.
+func (a *AuthorizedKeys) path(user string) (string, error) {
+	if a.UserPath == nil {
+		return a.Path, nil
+	}
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\") {
+		return "", fmt.Errorf("ssh: invalid user name %q", user)
+	}
+	return a.UserPath(user), nil
+}
+
+// load returns the parsed file, reading it again if it changed on disk.
+func (a *AuthorizedKeys) load(path string) (*keyFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if file, ok := a.files[path]; ok && file.modTime.Equal(info.ModTime()) && file.size == info.Size() {
+		return file, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &keyFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		entries: parseAuthorizedKeys(data),
+	}
+	if a.files == nil {
+		a.files = make(map[string]*keyFile)
+	}
+	a.files[path] = file
+	return file, nil
+}
+
+// parseAuthorizedKeys parses the entries of an authorized_keys file. Invalid
+// lines and keys with unknown options are skipped.
+func parseAuthorizedKeys(data []byte) []*authorizedKey {
+	var entries []*authorizedKey
+	for len(data) > 0 {
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+
+		entry, err := parseKeyOptions(options)
+		if err != nil {
+			continue
+		}
+		entry.key = string(key.Marshal())
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parseKeyOptions converts the authorized_keys options into permissions.
+func parseKeyOptions(options []string) (*authorizedKey, error) {
+	entry := &authorizedKey{
+		perms: ssh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{RestrictExtension: ""},
+		},
+	}
+	for _, permit := range permits {
+		entry.perms.Extensions[permit] = ""
+	}
+
+	var permitOpen, environment []string
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], unquoteOption(option[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "command":
+			entry.perms.CriticalOptions[ForceCommandOption] = value
+		case "environment":
+			if !strings.Contains(value, "=") {
+				return nil, fmt.Errorf("invalid environment %q", value)
+			}
+			environment = append(environment, value)
+		case "expiry-time":
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			entry.expiry = expiry
+		case "from":
+			entry.from = value
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, err
+			}
+			permitOpen = append(permitOpen, value)
+		case "restrict":
+			for _, permit := range permits {
+				delete(entry.perms.Extensions, permit)
+			}
+		case "no-port-forwarding":
+			delete(entry.perms.Extensions, PermitPortForwarding)
+		case "no-pty":
+			delete(entry.perms.Extensions, PermitPty)
+		case "no-agent-forwarding":
+			delete(entry.perms.Extensions, PermitAgentForwarding)
+		case "no-x11-forwarding":
+			delete(entry.perms.Extensions, PermitX11Forwarding)
+		case "no-user-rc":
+			delete(entry.perms.Extensions, PermitUserRC)
+		case "port-forwarding":
+			entry.perms.Extensions[PermitPortForwarding] = ""
+		case "pty":
+			entry.perms.Extensions[PermitPty] = ""
+		case "agent-forwarding":
+			entry.perms.Extensions[PermitAgentForwarding] = ""
+		case "x11-forwarding":
+			entry.perms.Extensions[PermitX11Forwarding] = ""
+		case "user-rc":
+			entry.perms.Extensions[PermitUserRC] = ""
+		default:
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	if len(permitOpen) > 0 {
+		entry.perms.Extensions[PermitOpenExtension] = strings.Join(permitOpen, ",")
+	}
+	if len(environment) > 0 {
+		entry.perms.Extensions[EnvironmentExtension] = strings.Join(environment, "\n")
+	}
+	return entry, nil
+}
+
+// unquoteOption removes the quotes around an option value.
+func unquoteOption(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.Replace(value, `\"`, `"`, -1)
+}
+
+// parseExpiryTime parses a YYYYMMDD[HHMM[SS]] time in the local time zone.
+func parseExpiryTime(value string) (time.Time, error) {
+	var layout string
+	switch len(value) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+	return time.ParseInLocation(layout, value, time.Local)
+}
+
+// matchFrom returns true if the address matches the from pattern list. Any
+// negated pattern which matches refuses the address.
+func matchFrom(patterns string, addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if strings.Contains(pattern, "/") {
+			_, ipnet, err := net.ParseCIDR(pattern)
+			ok = err == nil && ip != nil && ipnet.Contains(ip)
+		} else {
+			ok = matchWildcard(pattern, host)
+		}
+
+		if ok && negate {
+			return false
+		} else if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchWildcard matches a string against a pattern with '*' and '?' wildcards.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sshmocks "github.com/blacklabeldata/mockery/ssh"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func connFrom(user, addr string) *sshmocks.MockConnMetadata {
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	conn := &sshmocks.MockConnMetadata{UserName: user, Remote: remote}
+	conn.On("User").Return(user)
+	conn.On("RemoteAddr").Return(remote)
+	return conn
+}
+
+func authorizedLine(options string, key ssh.PublicKey) string {
+	line := string(ssh.MarshalAuthorizedKey(key))
+	if options != "" {
+		line = options + " " + line
+	}
+	return line
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authorized_keys")
+
+	plain := newSigner(t)
+	restricted := newSigner(t)
+	local := newSigner(t)
+	expired := newSigner(t)
+	unknown := newSigner(t)
+
+	data := "# keys\n" +
+		authorizedLine("", plain.PublicKey()) +
+		authorizedLine(`command="echo \"hi\"",no-pty,permitopen="db:5432",permitopen="cache:6379",environment="LANG=C",environment="TZ=UTC"`, restricted.PublicKey()) +
+		authorizedLine(`from="10.0.0.0/8,!10.0.0.13,192.168.?.*"`, local.PublicKey()) +
+		authorizedLine(`expiry-time="20000101"`, expired.PublicKey()) +
+		authorizedLine(`unknown-option`, unknown.PublicKey())
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	auth := &AuthorizedKeys{Path: path}
+
+	// Plain keys permit everything
+	perms, err := auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), plain.PublicKey())
+	if assert.Nil(t, err, "plain key should be accepted") {
+		assert.True(t, Permitted(perms, PermitPty))
+		assert.True(t, Permitted(perms, PermitPortForwarding))
+		_, ok := ForceCommand(perms)
+		assert.False(t, ok, "plain key should not force a command")
+	}
+
+	// Options end up in the permissions
+	perms, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), restricted.PublicKey())
+	if assert.Nil(t, err, "restricted key should be accepted") {
+		cmd, _ := ForceCommand(perms)
+		assert.Equal(t, `echo "hi"`, cmd)
+		assert.False(t, Permitted(perms, PermitPty), "pty should not be permitted")
+		assert.True(t, Permitted(perms, PermitPortForwarding), "port forwarding should be permitted")
+		assert.Equal(t, []string{"db:5432", "cache:6379"}, PermitOpen(perms))
+		assert.Equal(t, []string{"LANG=C", "TZ=UTC"}, Environment(perms))
+	}
+
+	// from= restricts the client address
+	_, err = auth.Authenticate(connFrom("jonny", "10.1.2.3:22"), local.PublicKey())
+	assert.Nil(t, err, "address in CIDR should be accepted")
+	_, err = auth.Authenticate(connFrom("jonny", "192.168.4.20:22"), local.PublicKey())
+	assert.Nil(t, err, "address matching wildcard should be accepted")
+	_, err = auth.Authenticate(connFrom("jonny", "10.0.0.13:22"), local.PublicKey())
+	assert.NotNil(t, err, "negated address should be refused")
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:22"), local.PublicKey())
+	assert.NotNil(t, err, "other addresses should be refused")
+
+	// Expired and unknown keys are refused
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), expired.PublicKey())
+	assert.NotNil(t, err, "expired key should be refused")
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), unknown.PublicKey())
+	assert.Equal(t, ErrUnauthorizedKey, err, "key with unknown options should be ignored")
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), newSigner(t).PublicKey())
+	assert.Equal(t, ErrUnauthorizedKey, err, "unlisted key should be refused")
+
+	// The file is read again when it changes
+	if err := ioutil.WriteFile(path, []byte(authorizedLine("", unknown.PublicKey())), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), unknown.PublicKey())
+	assert.Nil(t, err, "new key should be accepted after the file changes")
+	_, err = auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), plain.PublicKey())
+	assert.Equal(t, ErrUnauthorizedKey, err, "removed key should be refused after the file changes")
+}
+
+func TestAuthorizedKeysPerUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	key := newSigner(t)
+	ioutil.WriteFile(filepath.Join(dir, "jonny"), []byte(authorizedLine("restrict,pty", key.PublicKey())), 0600)
+
+	auth := &AuthorizedKeys{
+		UserPath: func(user string) string {
+			return filepath.Join(dir, user)
+		},
+	}
+
+	perms, err := auth.Authenticate(connFrom("jonny", "203.0.113.7:1234"), key.PublicKey())
+	if assert.Nil(t, err, "key should be accepted for its user") {
+		assert.True(t, Permitted(perms, PermitPty), "pty should be permitted")
+		assert.False(t, Permitted(perms, PermitPortForwarding), "port forwarding should be restricted")
+	}
+
+	_, err = auth.Authenticate(connFrom("hadji", "203.0.113.7:1234"), key.PublicKey())
+	assert.NotNil(t, err, "key should be refused for other users")
+
+	_, err = auth.Authenticate(connFrom("../jonny", "203.0.113.7:1234"), key.PublicKey())
+	assert.NotNil(t, err, "user names with paths should be refused")
+}
+
+func TestPermitted(t *testing.T) {
+	assert.True(t, Permitted(nil, PermitPty), "nil permissions allow everything")
+	assert.True(t, Permitted(&ssh.Permissions{Extensions: map[string]string{"username": "jonny"}}, PermitPty),
+		"permissions without restrictions allow everything")
+	assert.False(t, Permitted(&ssh.Permissions{Extensions: map[string]string{RestrictExtension: ""}}, PermitPty),
+		"restricted permissions only allow listed features")
+	assert.Nil(t, PermitOpen(nil))
+	assert.Nil(t, Environment(&ssh.Permissions{}))
+}
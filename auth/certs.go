@@ -0,0 +1,115 @@
+// Package auth provides ready-made authentication callbacks for sshh servers.
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ForceCommandOption is the critical option which forces the command
+	// run for a session, whatever the client requested.
+	ForceCommandOption = "force-command"
+
+	// SourceAddressOption is the critical option which restricts the
+	// addresses a certificate can be used from. It is enforced by the SSH
+	// server during authentication.
+	SourceAddressOption = "source-address"
+)
+
+// ErrNoPrincipals is returned for user certificates without any principals.
+var ErrNoPrincipals = errors.New("ssh: certificate has no principals")
+
+// ForceCommand returns the command which must be run instead of the one
+// requested by the client, if the permissions force one. Sessions run it, see
+// session.New.
+func ForceCommand(perms *ssh.Permissions) (string, bool) {
+	if perms == nil || perms.CriticalOptions == nil {
+		return "", false
+	}
+	cmd, ok := perms.CriticalOptions[ForceCommandOption]
+	return cmd, ok
+}
+
+// CertAuthority authenticates users with OpenSSH certificates signed by one of
+// the trusted Authorities. Certificates are checked against their validity
+// window, their principals must include the login user, and revoked
+// certificates are refused. The force-command and source-address critical
+// options are supported and any other critical option is refused. Critical
+// options and extensions are passed through to the ssh.Permissions.
+//
+// Authenticate can be used as the Config PublicKeyCallback.
+type CertAuthority struct {
+
+	// Authorities are the public keys of the trusted certificate authorities.
+	Authorities []ssh.PublicKey
+
+	// Revoked, if non-nil, is checked for every certificate.
+	Revoked *RevocationList
+
+	// Fallback, if non-nil, is called for public keys which are not
+	// certificates. Otherwise those keys are refused.
+	Fallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)
+
+	// Clock is used to check the validity window. If nil, time.Now is used.
+	Clock func() time.Time
+}
+
+// Authenticate checks the certificate presented by the client.
+func (a *CertAuthority) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok && cert.CertType == ssh.UserCert && len(cert.ValidPrincipals) == 0 {
+		return nil, ErrNoPrincipals
+	}
+
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: []string{ForceCommandOption, SourceAddressOption},
+		IsAuthority:              a.isAuthority,
+		Clock:                    a.Clock,
+		UserKeyFallback:          a.Fallback,
+	}
+	if a.Revoked != nil {
+		checker.IsRevoked = a.Revoked.IsRevoked
+	}
+
+	perms, err := checker.Authenticate(conn, key)
+	if err != nil || perms == nil {
+		return perms, err
+	}
+
+	// Only the permit-* extensions of certificates are allowed
+	if _, ok := key.(*ssh.Certificate); ok {
+		perms = copyPermissions(perms)
+		perms.Extensions[RestrictExtension] = ""
+	}
+	return perms, nil
+}
+
+// isAuthority returns true if the key is one of the trusted authorities.
+func (a *CertAuthority) isAuthority(key ssh.PublicKey) bool {
+	data := key.Marshal()
+	for _, auth := range a.Authorities {
+		if bytes.Equal(auth.Marshal(), data) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyPermissions copies the permissions so that the certificate is not
+// modified by handlers.
+func copyPermissions(perms *ssh.Permissions) *ssh.Permissions {
+	out := &ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(perms.CriticalOptions)),
+		Extensions:      make(map[string]string, len(perms.Extensions)),
+	}
+	for k, v := range perms.CriticalOptions {
+		out.CriticalOptions[k] = v
+	}
+	for k, v := range perms.Extensions {
+		out.Extensions[k] = v
+	}
+	return out
+}
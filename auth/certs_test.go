@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	sshmocks "github.com/blacklabeldata/mockery/ssh"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signer
+}
+
+func newCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, serial uint64, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           "jonny",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{"permit-pty": ""},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err.Error())
+	}
+	return cert
+}
+
+func connFor(user string) *sshmocks.MockConnMetadata {
+	conn := &sshmocks.MockConnMetadata{UserName: user}
+	conn.On("User").Return(user)
+	return conn
+}
+
+func TestCertAuthority(t *testing.T) {
+	ca := newSigner(t)
+	other := newSigner(t)
+	user := newSigner(t)
+
+	revoked, err := ParseRevocationList([]byte("serial: 13\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	auth := &CertAuthority{
+		Authorities: []ssh.PublicKey{ca.PublicKey()},
+		Revoked:     revoked,
+	}
+
+	// Valid certificates should be accepted with their extensions
+	perms, err := auth.Authenticate(connFor("jonny"), newCert(t, ca, user.PublicKey(), 1, "jonny"))
+	if assert.Nil(t, err, "certificate should be accepted") {
+		_, ok := perms.Extensions["permit-pty"]
+		assert.True(t, ok, "extensions should be passed through")
+	}
+
+	// Principals must include the login user
+	_, err = auth.Authenticate(connFor("hadji"), newCert(t, ca, user.PublicKey(), 1, "jonny"))
+	assert.NotNil(t, err, "certificate for another principal should be refused")
+
+	_, err = auth.Authenticate(connFor("jonny"), newCert(t, ca, user.PublicKey(), 1))
+	assert.Equal(t, ErrNoPrincipals, err, "certificate without principals should be refused")
+
+	// Only trusted authorities are accepted
+	_, err = auth.Authenticate(connFor("jonny"), newCert(t, other, user.PublicKey(), 1, "jonny"))
+	assert.NotNil(t, err, "certificate from an unknown CA should be refused")
+
+	// Revoked certificates are refused
+	_, err = auth.Authenticate(connFor("jonny"), newCert(t, ca, user.PublicKey(), 13, "jonny"))
+	assert.NotNil(t, err, "revoked certificate should be refused")
+
+	// Certificates outside their validity window are refused
+	cert := newCert(t, ca, user.PublicKey(), 1, "jonny")
+	auth.Clock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = auth.Authenticate(connFor("jonny"), cert)
+	assert.NotNil(t, err, "expired certificate should be refused")
+	auth.Clock = nil
+
+	// Plain keys need a fallback
+	_, err = auth.Authenticate(connFor("jonny"), user.PublicKey())
+	assert.NotNil(t, err, "plain keys should be refused")
+
+	auth.Fallback = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return &ssh.Permissions{}, nil
+	}
+	_, err = auth.Authenticate(connFor("jonny"), user.PublicKey())
+	assert.Nil(t, err, "plain keys should use the fallback")
+}
+
+func TestCertCriticalOptions(t *testing.T) {
+	ca := newSigner(t)
+	user := newSigner(t)
+	auth := &CertAuthority{Authorities: []ssh.PublicKey{ca.PublicKey()}}
+
+	// force-command is passed through
+	cert := newCert(t, ca, user.PublicKey(), 1, "jonny")
+	cert.CriticalOptions[ForceCommandOption] = "/usr/bin/uptime"
+	cert.SignCert(rand.Reader, ca)
+
+	perms, err := auth.Authenticate(connFor("jonny"), cert)
+	if assert.Nil(t, err, "certificate should be accepted") {
+		cmd, ok := ForceCommand(perms)
+		assert.True(t, ok, "command should be forced")
+		assert.Equal(t, "/usr/bin/uptime", cmd)
+	}
+
+	// Unknown critical options are refused
+	cert = newCert(t, ca, user.PublicKey(), 1, "jonny")
+	cert.CriticalOptions["verify-required"] = ""
+	cert.SignCert(rand.Reader, ca)
+
+	_, err = auth.Authenticate(connFor("jonny"), cert)
+	assert.NotNil(t, err, "unknown critical options should be refused")
+
+	_, ok := ForceCommand(nil)
+	assert.False(t, ok, "nil permissions should not force a command")
+}
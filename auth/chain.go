@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authentication method names used in chains.
+const (
+	MethodPassword            = "password"
+	MethodPublicKey           = "publickey"
+	MethodKeyboardInteractive = "keyboard-interactive"
+)
+
+var (
+	// ErrPartialAuth is returned when a method succeeded but the user must
+	// still complete other methods of their chain.
+	ErrPartialAuth = errors.New("ssh: further authentication required")
+
+	// ErrMethodNotAllowed is returned when a method is not part of any
+	// chain of the user.
+	ErrMethodNotAllowed = errors.New("ssh: authentication method not allowed")
+)
+
+// Chain lists the authentication methods a user must all complete, such as
+// Chain{MethodKeyboardInteractive, MethodPublicKey}.
+type Chain []string
+
+// MultiFactor requires users to complete more than one authentication method.
+// Chains are declared per user or per group, and a user is authenticated once
+// every method of any one of their chains has succeeded on the connection.
+// Users without chains may use any single method.
+//
+// Public keys must be the last method of a chain. The SSH package cannot tell
+// clients that a method partially succeeded, a public key is only proven after
+// the callback returns, and the result of the callback is cached for the rest
+// of the connection. A public key tried before the other methods of its chain
+// therefore fails with ErrPartialAuth, and keeps failing on that connection
+// even once the other methods succeed. For OpenSSH clients this means setting
+// PreferredAuthentications, for example to keyboard-interactive,publickey.
+//
+// PasswordCallback, PublicKeyCallback and KeyboardInteractiveCallback can be
+// used as the Config callbacks of the same names. The ssh.Permissions of every
+// method in the chain are merged.
+type MultiFactor struct {
+
+	// Users maps user names to their chains.
+	Users map[string][]Chain
+
+	// Groups maps group names to their chains. They are used for users
+	// without chains of their own.
+	Groups map[string][]Chain
+
+	// UserGroups, if non-nil, returns the groups of a user.
+	UserGroups func(user string) []string
+
+	// Default chains are used for users without user or group chains.
+	Default []Chain
+
+	// Password, PublicKey and KeyboardInteractive check each method.
+	Password            func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)
+	PublicKey           func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)
+	KeyboardInteractive func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+
+	// Timeout is how long the progress of incomplete chains is kept. If
+	// zero, 10 minutes is used.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*progress
+}
+
+// progress holds the methods completed on a connection.
+type progress struct {
+	methods map[string]*ssh.Permissions
+	expires time.Time
+}
+
+// PasswordCallback checks the password as one method of the chain.
+func (m *MultiFactor) PasswordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if m.Password == nil {
+		return nil, ErrMethodNotAllowed
+	}
+	perms, err := m.Password(conn, password)
+	if err != nil {
+		return nil, err
+	}
+	return m.complete(conn, MethodPassword, perms)
+}
+
+// PublicKeyCallback checks the key as the last method of the chain. It returns
+// ErrPartialAuth if other methods of the chain are not completed yet.
+func (m *MultiFactor) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if m.PublicKey == nil {
+		return nil, ErrMethodNotAllowed
+	}
+	perms, err := m.PublicKey(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	return m.complete(conn, MethodPublicKey, perms)
+}
+
+// KeyboardInteractiveCallback runs the challenge as one method of the chain.
+func (m *MultiFactor) KeyboardInteractiveCallback(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	if m.KeyboardInteractive == nil {
+		return nil, ErrMethodNotAllowed
+	}
+	perms, err := m.KeyboardInteractive(conn, client)
+	if err != nil {
+		return nil, err
+	}
+	return m.complete(conn, MethodKeyboardInteractive, perms)
+}
+
+// Chains returns the chains of the user.
+func (m *MultiFactor) Chains(user string) []Chain {
+	if chains, ok := m.Users[user]; ok {
+		return chains
+	}
+
+	var chains []Chain
+	if m.UserGroups != nil {
+		for _, group := range m.UserGroups(user) {
+			chains = append(chains, m.Groups[group]...)
+		}
+	}
+	if len(chains) > 0 {
+		return chains
+	}
+	return m.Default
+}
+
+// complete records the method which succeeded and returns the merged
+// permissions if a chain is now complete.
+func (m *MultiFactor) complete(conn ssh.ConnMetadata, method string, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	chains := m.Chains(conn.User())
+	if len(chains) == 0 {
+		return perms, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	// Progress is kept per user as clients may change the user name
+	key := string(conn.SessionID()) + "\x00" + conn.User()
+	p, ok := m.pending[key]
+	if !ok {
+		p = &progress{methods: make(map[string]*ssh.Permissions)}
+	}
+
+	methods := make(map[string]*ssh.Permissions, len(p.methods)+1)
+	for name, perms := range p.methods {
+		methods[name] = perms
+	}
+	methods[method] = perms
+
+	allowed := false
+	for _, chain := range chains {
+		if !chain.contains(method) {
+			continue
+		}
+		allowed = true
+		if chain.completedBy(methods) {
+			delete(m.pending, key)
+			return mergePermissions(chain, methods), nil
+		}
+	}
+	if !allowed {
+		return nil, ErrMethodNotAllowed
+	}
+
+	// Public keys are not proven until after the callback returns
+	if method == MethodPublicKey {
+		return nil, ErrPartialAuth
+	}
+
+	p.methods = methods
+	p.expires = time.Now().Add(m.timeout())
+	if m.pending == nil {
+		m.pending = make(map[string]*progress)
+	}
+	m.pending[key] = p
+	return nil, ErrPartialAuth
+}
+
+// expire removes the progress of abandoned connections.
+func (m *MultiFactor) expire() {
+	now := time.Now()
+	for key, p := range m.pending {
+		if now.After(p.expires) {
+			delete(m.pending, key)
+		}
+	}
+}
+
+func (m *MultiFactor) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return 10 * time.Minute
+	}
+	return m.Timeout
+}
+
+func (c Chain) contains(method string) bool {
+	for _, name := range c {
+		if name == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Chain) completedBy(methods map[string]*ssh.Permissions) bool {
+	for _, name := range c {
+		if _, ok := methods[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mergePermissions combines the permissions of the methods in the chain.
+func mergePermissions(chain Chain, methods map[string]*ssh.Permissions) *ssh.Permissions {
+	out := &ssh.Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+	for _, name := range chain {
+		perms := methods[name]
+		if perms == nil {
+			continue
+		}
+		for k, v := range perms.CriticalOptions {
+			out.CriticalOptions[k] = v
+		}
+		for k, v := range perms.Extensions {
+			out.Extensions[k] = v
+		}
+	}
+	return out
+}
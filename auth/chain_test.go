@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func sessionFor(user, session string) ssh.ConnMetadata {
+	conn := connFor(user)
+	conn.SessionData = []byte(session)
+	conn.On("SessionID").Return(conn.SessionData)
+	return conn
+}
+
+// handshake authenticates a client with the methods, in order.
+func handshake(t *testing.T, config *ssh.ServerConfig, methods ...ssh.AuthMethod) (*ssh.Permissions, error) {
+	config.AddHostKey(newSigner(t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	done := make(chan *ssh.ServerConn, 1)
+	go func() {
+		server, err := l.Accept()
+		if err != nil {
+			done <- nil
+			return
+		}
+		conn, _, _, err := ssh.NewServerConn(server, config)
+		if err != nil {
+			server.Close()
+			done <- nil
+			return
+		}
+		done <- conn
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	_, _, _, err = ssh.NewClientConn(client, "pipe", &ssh.ClientConfig{User: "jonny", Auth: methods})
+	if err != nil {
+		client.Close()
+	}
+	conn := <-done
+	if conn == nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Permissions, err
+}
+
+func TestMultiFactorChains(t *testing.T) {
+	mf := &MultiFactor{
+		Users: map[string][]Chain{
+			"jonny": {{MethodPassword, MethodKeyboardInteractive}},
+		},
+		Groups: map[string][]Chain{
+			"admins": {{MethodKeyboardInteractive, MethodPublicKey}},
+		},
+		UserGroups: func(user string) []string {
+			if user == "race" {
+				return []string{"admins"}
+			}
+			return nil
+		},
+		Password: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "bandit" {
+				return nil, errors.New("wrong password")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"password": ""}}, nil
+		},
+		KeyboardInteractive: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"otp": ""}}, nil
+		},
+	}
+
+	assert.Equal(t, []Chain{{MethodKeyboardInteractive, MethodPublicKey}}, mf.Chains("race"))
+	assert.Nil(t, mf.Chains("hadji"), "users without chains should use the default")
+
+	// Users without chains only need a single method
+	perms, err := mf.PasswordCallback(sessionFor("hadji", "1"), []byte("bandit"))
+	assert.Nil(t, err)
+	assert.NotNil(t, perms)
+
+	// The password alone is not enough
+	_, err = mf.PasswordCallback(sessionFor("jonny", "2"), []byte("bandit"))
+	assert.Equal(t, ErrPartialAuth, err)
+
+	// Progress is kept per connection
+	_, err = mf.KeyboardInteractiveCallback(sessionFor("jonny", "3"), nil)
+	assert.Equal(t, ErrPartialAuth, err, "progress should not be shared between connections")
+
+	perms, err = mf.KeyboardInteractiveCallback(sessionFor("jonny", "2"), nil)
+	if assert.Nil(t, err, "chain should be complete") {
+		assert.Equal(t, map[string]string{"password": "", "otp": ""}, perms.Extensions, "permissions should be merged")
+	}
+
+	// Failed methods are not recorded
+	_, err = mf.PasswordCallback(sessionFor("jonny", "4"), []byte("wrong"))
+	assert.NotNil(t, err)
+	_, err = mf.KeyboardInteractiveCallback(sessionFor("jonny", "4"), nil)
+	assert.Equal(t, ErrPartialAuth, err)
+
+	// Methods outside the chains are refused
+	_, err = mf.PublicKeyCallback(sessionFor("jonny", "5"), newSigner(t).PublicKey())
+	assert.Equal(t, ErrMethodNotAllowed, err, "methods without a callback should be refused")
+	mf.PublicKey = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil }
+	_, err = mf.PublicKeyCallback(sessionFor("jonny", "5"), newSigner(t).PublicKey())
+	assert.Equal(t, ErrMethodNotAllowed, err, "methods outside the chain should be refused")
+
+	// Public keys only count as the last method
+	key := newSigner(t).PublicKey()
+	_, err = mf.PublicKeyCallback(sessionFor("race", "6"), key)
+	assert.Equal(t, ErrPartialAuth, err)
+	_, err = mf.KeyboardInteractiveCallback(sessionFor("race", "6"), nil)
+	assert.Equal(t, ErrPartialAuth, err, "public key should not be recorded before it is proven")
+	_, err = mf.PublicKeyCallback(sessionFor("race", "6"), key)
+	assert.Nil(t, err)
+
+	// Abandoned progress expires
+	mf.Timeout = time.Nanosecond
+	_, err = mf.PasswordCallback(sessionFor("jonny", "7"), []byte("bandit"))
+	assert.Equal(t, ErrPartialAuth, err)
+	time.Sleep(time.Millisecond)
+	_, err = mf.KeyboardInteractiveCallback(sessionFor("jonny", "7"), nil)
+	assert.Equal(t, ErrPartialAuth, err, "progress should expire")
+}
+
+func TestMultiFactorHandshake(t *testing.T) {
+	user := newSigner(t)
+	secret := []byte("12345678901234567890")
+	totp := &TOTP{Secrets: StaticSecrets{"jonny": secret}}
+
+	newConfig := func() *ssh.ServerConfig {
+		mf := &MultiFactor{
+			Default: []Chain{{MethodKeyboardInteractive, MethodPublicKey}},
+			PublicKey: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !bytes.Equal(key.Marshal(), user.PublicKey().Marshal()) {
+					return nil, ErrUnauthorizedKey
+				}
+				return &ssh.Permissions{Extensions: map[string]string{"key": ""}}, nil
+			},
+			KeyboardInteractive: totp.KeyboardInteractive,
+		}
+		return &ssh.ServerConfig{
+			PublicKeyCallback:           mf.PublicKeyCallback,
+			KeyboardInteractiveCallback: mf.KeyboardInteractiveCallback,
+		}
+	}
+	code := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{totp.Code(secret, time.Now())}, nil
+	}
+
+	// The code followed by the key completes the chain
+	perms, err := handshake(t, newConfig(), ssh.KeyboardInteractive(code), ssh.PublicKeys(user))
+	if assert.Nil(t, err, "chain should be completed") {
+		_, ok := perms.Extensions["key"]
+		assert.True(t, ok, "permissions should be passed through")
+	}
+
+	// Neither method is enough alone
+	_, err = handshake(t, newConfig(), ssh.PublicKeys(user))
+	assert.NotNil(t, err, "public key alone should be refused")
+	_, err = handshake(t, newConfig(), ssh.KeyboardInteractive(code))
+	assert.NotNil(t, err, "code alone should be refused")
+
+	// Public keys must be tried last
+	_, err = handshake(t, newConfig(), ssh.PublicKeys(user), ssh.KeyboardInteractive(code), ssh.PublicKeys(user))
+	assert.NotNil(t, err, "public key before the code should be refused")
+}
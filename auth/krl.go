@@ -0,0 +1,429 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// krlMagic starts every binary OpenSSH key revocation list.
+var krlMagic = []byte("SSHKRL\n\x00")
+
+// KRL section types, see PROTOCOL.krl in the OpenSSH sources.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+// ErrInvalidKRL is returned when a binary key revocation list cannot be parsed.
+var ErrInvalidKRL = errors.New("invalid key revocation list")
+
+// RevocationList holds revoked keys and certificates. It can be parsed from an
+// OpenSSH binary KRL or from a plain text file in the format accepted by
+// `ssh-keygen -k`, with one entry per line:
+//
+//	serial: 1234
+//	serial: 1000-1999
+//	id: key id
+//	key: ssh-rsa AAAA...
+//
+// Blank lines and lines starting with '#' are ignored. Entries in a plain text
+// file apply to certificates from every authority. Signatures on binary KRLs
+// are not verified.
+type RevocationList struct {
+	mu sync.RWMutex
+
+	// certs holds the revoked certificates by the marshaled CA key. The
+	// empty key holds certificates revoked for every CA.
+	certs map[string]*revokedCerts
+
+	// keys holds the revoked marshaled public keys
+	keys map[string]bool
+
+	// sha1 and sha256 hold the revoked key fingerprints
+	sha1   map[string]bool
+	sha256 map[string]bool
+}
+
+// revokedCerts holds the revoked certificates for a single CA.
+type revokedCerts struct {
+	serials []serialRange
+	bitmaps []serialBitmap
+	ids     map[string]bool
+}
+
+type serialRange struct {
+	min, max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+// revoked returns true if the serial or key ID has been revoked.
+func (r *revokedCerts) revoked(cert *ssh.Certificate) bool {
+	if r.ids[cert.KeyId] {
+		return true
+	}
+	for _, s := range r.serials {
+		if cert.Serial >= s.min && cert.Serial <= s.max {
+			return true
+		}
+	}
+	for _, b := range r.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bits.BitLen()) &&
+			b.bits.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRevocationList returns an empty revocation list.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		certs:  make(map[string]*revokedCerts),
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// LoadRevocationList reads a binary KRL or plain text revocation file.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	rl := NewRevocationList()
+	if err := rl.Load(path); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// ParseRevocationList parses a binary KRL or plain text revocation list.
+func ParseRevocationList(data []byte) (*RevocationList, error) {
+	rl := NewRevocationList()
+	if bytes.HasPrefix(data, krlMagic) {
+		if err := rl.parseKRL(data); err != nil {
+			return nil, err
+		}
+	} else if err := rl.parseText(data); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Load replaces the contents of the list with the file at the given path.
+// If the file cannot be parsed the list is left unchanged.
+func (rl *RevocationList) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := ParseRevocationList(data)
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	rl.certs, rl.keys, rl.sha1, rl.sha256 = parsed.certs, parsed.keys, parsed.sha1, parsed.sha256
+	rl.mu.Unlock()
+	return nil
+}
+
+// IsRevoked returns true if the certificate, or the key it certifies, has been
+// revoked. It can be used as the ssh.CertChecker IsRevoked callback.
+func (rl *RevocationList) IsRevoked(cert *ssh.Certificate) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	if rl.keyRevoked(cert.Key) {
+		return true
+	}
+	if r, ok := rl.certs[""]; ok && r.revoked(cert) {
+		return true
+	}
+	if r, ok := rl.certs[string(cert.SignatureKey.Marshal())]; ok && r.revoked(cert) {
+		return true
+	}
+	return false
+}
+
+// IsKeyRevoked returns true if the plain public key has been revoked.
+func (rl *RevocationList) IsKeyRevoked(key ssh.PublicKey) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.keyRevoked(key)
+}
+
+func (rl *RevocationList) keyRevoked(key ssh.PublicKey) bool {
+	data := key.Marshal()
+	if rl.keys[string(data)] {
+		return true
+	}
+	sum1 := sha1.Sum(data)
+	sum256 := sha256.Sum256(data)
+	return rl.sha1[string(sum1[:])] || rl.sha256[string(sum256[:])]
+}
+
+// ca returns the revoked certificates for the given marshaled CA key.
+func (rl *RevocationList) ca(key string) *revokedCerts {
+	r, ok := rl.certs[key]
+	if !ok {
+		r = &revokedCerts{ids: make(map[string]bool)}
+		rl.certs[key] = r
+	}
+	return r
+}
+
+// parseText parses the plain text format used by `ssh-keygen -k`.
+func (rl *RevocationList) parseText(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("revocation list line %d: missing ':'", n)
+		}
+		kind, value := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+
+		switch kind {
+		case "serial":
+			min, max := value, value
+			if j := strings.Index(value, "-"); j >= 0 {
+				min, max = value[:j], value[j+1:]
+			}
+			lo, err := strconv.ParseUint(strings.TrimSpace(min), 0, 64)
+			if err != nil {
+				return fmt.Errorf("revocation list line %d: invalid serial %q", n, value)
+			}
+			hi, err := strconv.ParseUint(strings.TrimSpace(max), 0, 64)
+			if err != nil || hi < lo {
+				return fmt.Errorf("revocation list line %d: invalid serial %q", n, value)
+			}
+			r := rl.ca("")
+			r.serials = append(r.serials, serialRange{lo, hi})
+
+		case "id":
+			rl.ca("").ids[value] = true
+
+		case "key":
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil {
+				return fmt.Errorf("revocation list line %d: %s", n, err)
+			}
+			rl.keys[string(key.Marshal())] = true
+
+		default:
+			return fmt.Errorf("revocation list line %d: unknown entry %q", n, kind)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseKRL parses a binary OpenSSH key revocation list.
+func (rl *RevocationList) parseKRL(data []byte) error {
+	r := krlReader(data[len(krlMagic):])
+
+	// Header: format version, KRL version, generated date, flags,
+	// reserved and comment
+	version, ok := r.readUint32()
+	if !ok || version != 1 {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readUint64(); !ok {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readUint64(); !ok {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readUint64(); !ok {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readString(); !ok {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readString(); !ok {
+		return ErrInvalidKRL
+	}
+
+	for len(r) > 0 {
+		sectionType, ok := r.readByte()
+		if !ok {
+			return ErrInvalidKRL
+		}
+
+		// Signatures always come last
+		if sectionType == krlSectionSignature {
+			return nil
+		}
+
+		section, ok := r.readString()
+		if !ok {
+			return ErrInvalidKRL
+		}
+
+		var err error
+		switch sectionType {
+		case krlSectionCertificates:
+			err = rl.parseKRLCerts(krlReader(section))
+		case krlSectionExplicitKey:
+			err = parseKRLStrings(krlReader(section), rl.keys)
+		case krlSectionFingerprintSHA1:
+			err = parseKRLStrings(krlReader(section), rl.sha1)
+		case krlSectionFingerprintSHA256:
+			err = parseKRLStrings(krlReader(section), rl.sha256)
+		default:
+			err = ErrInvalidKRL
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseKRLCerts parses a certificates section.
+func (rl *RevocationList) parseKRLCerts(r krlReader) error {
+	caKey, ok := r.readString()
+	if !ok {
+		return ErrInvalidKRL
+	}
+	if _, ok = r.readString(); !ok {
+		return ErrInvalidKRL
+	}
+	certs := rl.ca(string(caKey))
+
+	for len(r) > 0 {
+		sectionType, ok := r.readByte()
+		if !ok {
+			return ErrInvalidKRL
+		}
+		data, ok := r.readString()
+		if !ok {
+			return ErrInvalidKRL
+		}
+		section := krlReader(data)
+
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for len(section) > 0 {
+				serial, ok := section.readUint64()
+				if !ok {
+					return ErrInvalidKRL
+				}
+				certs.serials = append(certs.serials, serialRange{serial, serial})
+			}
+
+		case krlSectionCertSerialRange:
+			min, ok := section.readUint64()
+			if !ok {
+				return ErrInvalidKRL
+			}
+			max, ok := section.readUint64()
+			if !ok || max < min {
+				return ErrInvalidKRL
+			}
+			certs.serials = append(certs.serials, serialRange{min, max})
+
+		case krlSectionCertSerialBitmap:
+			offset, ok := section.readUint64()
+			if !ok {
+				return ErrInvalidKRL
+			}
+			bitmap, ok := section.readString()
+			if !ok {
+				return ErrInvalidKRL
+			}
+			certs.bitmaps = append(certs.bitmaps, serialBitmap{offset, new(big.Int).SetBytes(bitmap)})
+
+		case krlSectionCertKeyID:
+			for len(section) > 0 {
+				id, ok := section.readString()
+				if !ok {
+					return ErrInvalidKRL
+				}
+				certs.ids[string(id)] = true
+			}
+
+		default:
+			return ErrInvalidKRL
+		}
+	}
+	return nil
+}
+
+// parseKRLStrings adds every string in the section to the set.
+func parseKRLStrings(r krlReader, set map[string]bool) error {
+	for len(r) > 0 {
+		s, ok := r.readString()
+		if !ok {
+			return ErrInvalidKRL
+		}
+		set[string(s)] = true
+	}
+	return nil
+}
+
+// krlReader reads SSH wire format values from a byte slice.
+type krlReader []byte
+
+func (r *krlReader) readByte() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	b := (*r)[0]
+	*r = (*r)[1:]
+	return b, true
+}
+
+func (r *krlReader) readUint32() (uint32, bool) {
+	if len(*r) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, true
+}
+
+func (r *krlReader) readUint64() (uint64, bool) {
+	if len(*r) < 8 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v, true
+}
+
+func (r *krlReader) readString() ([]byte, bool) {
+	n, ok := r.readUint32()
+	if !ok || uint64(len(*r)) < uint64(n) {
+		return nil, false
+	}
+	s := (*r)[:n]
+	*r = (*r)[n:]
+	return s, true
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// krlWriter builds binary KRLs for the tests.
+type krlWriter []byte
+
+func (w *krlWriter) byte(b byte) {
+	*w = append(*w, b)
+}
+
+func (w *krlWriter) uint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	*w = append(*w, buf[:]...)
+}
+
+func (w *krlWriter) uint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	*w = append(*w, buf[:]...)
+}
+
+func (w *krlWriter) string(s []byte) {
+	w.uint32(uint32(len(s)))
+	*w = append(*w, s...)
+}
+
+func (w *krlWriter) section(t byte, data krlWriter) {
+	w.byte(t)
+	w.string(data)
+}
+
+func newKRL(sections func(w *krlWriter)) []byte {
+	w := krlWriter(append([]byte{}, krlMagic...))
+	w.uint32(1)
+	w.uint64(1)
+	w.uint64(0)
+	w.uint64(0)
+	w.string(nil)
+	w.string([]byte("test"))
+	sections(&w)
+	return w
+}
+
+func TestParseKRL(t *testing.T) {
+	ca := newSigner(t)
+	user := newSigner(t)
+	revokedKey := newSigner(t)
+	fingerprinted := newSigner(t)
+
+	data := newKRL(func(w *krlWriter) {
+
+		// Certificates from the CA
+		var certs krlWriter
+		certs.string(ca.PublicKey().Marshal())
+		certs.string(nil)
+
+		var list krlWriter
+		list.uint64(5)
+		list.uint64(7)
+		certs.section(krlSectionCertSerialList, list)
+
+		var rng krlWriter
+		rng.uint64(100)
+		rng.uint64(200)
+		certs.section(krlSectionCertSerialRange, rng)
+
+		// Serials 1000 and 1002
+		var bitmap krlWriter
+		bitmap.uint64(1000)
+		bitmap.string([]byte{0x05})
+		certs.section(krlSectionCertSerialBitmap, bitmap)
+
+		var ids krlWriter
+		ids.string([]byte("stolen"))
+		certs.section(krlSectionCertKeyID, ids)
+		w.section(krlSectionCertificates, certs)
+
+		// Explicit keys
+		var keys krlWriter
+		keys.string(revokedKey.PublicKey().Marshal())
+		w.section(krlSectionExplicitKey, keys)
+
+		// Fingerprints
+		sum := sha256.Sum256(fingerprinted.PublicKey().Marshal())
+		var fingerprints krlWriter
+		fingerprints.string(sum[:])
+		w.section(krlSectionFingerprintSHA256, fingerprints)
+
+		// Signature sections are skipped
+		w.byte(krlSectionSignature)
+		w.string([]byte("key"))
+		w.string([]byte("signature"))
+	})
+
+	rl, err := ParseRevocationList(data)
+	if !assert.Nil(t, err, "KRL should be parsed") {
+		return
+	}
+
+	tests := []struct {
+		serial  uint64
+		revoked bool
+	}{
+		{5, true}, {6, false}, {7, true},
+		{99, false}, {100, true}, {150, true}, {200, true}, {201, false},
+		{999, false}, {1000, true}, {1001, false}, {1002, true}, {1003, false},
+	}
+	for _, test := range tests {
+		cert := newCert(t, ca, user.PublicKey(), test.serial, "jonny")
+		assert.Equal(t, test.revoked, rl.IsRevoked(cert), "serial %d", test.serial)
+	}
+
+	// Key IDs
+	cert := newCert(t, ca, user.PublicKey(), 1, "jonny")
+	cert.KeyId = "stolen"
+	assert.True(t, rl.IsRevoked(cert), "key ID should be revoked")
+
+	// Other CAs are not affected
+	other := newSigner(t)
+	assert.False(t, rl.IsRevoked(newCert(t, other, user.PublicKey(), 5, "jonny")), "serial from another CA should not be revoked")
+
+	// Keys and fingerprints
+	assert.True(t, rl.IsRevoked(newCert(t, other, revokedKey.PublicKey(), 1, "jonny")), "certificate for a revoked key should be revoked")
+	assert.True(t, rl.IsKeyRevoked(revokedKey.PublicKey()), "key should be revoked")
+	assert.True(t, rl.IsKeyRevoked(fingerprinted.PublicKey()), "fingerprint should be revoked")
+	assert.False(t, rl.IsKeyRevoked(user.PublicKey()), "key should not be revoked")
+
+	// Truncated KRLs are invalid
+	_, err = ParseRevocationList(data[:len(krlMagic)+10])
+	assert.Equal(t, ErrInvalidKRL, err)
+}
+
+func TestParseRevocationText(t *testing.T) {
+	ca := newSigner(t)
+	user := newSigner(t)
+	revokedKey := newSigner(t)
+
+	data := "# revoked\n\nserial: 5\nserial: 0x10-0x20\nid: stolen\nkey: " +
+		string(ssh.MarshalAuthorizedKey(revokedKey.PublicKey()))
+	rl, err := ParseRevocationList([]byte(data))
+	if !assert.Nil(t, err, "revocation list should be parsed") {
+		return
+	}
+
+	assert.True(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 5, "jonny")))
+	assert.True(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 24, "jonny")))
+	assert.False(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 6, "jonny")))
+	assert.True(t, rl.IsKeyRevoked(revokedKey.PublicKey()))
+
+	cert := newCert(t, ca, user.PublicKey(), 1, "jonny")
+	cert.KeyId = "stolen"
+	assert.True(t, rl.IsRevoked(cert), "key ID should be revoked")
+
+	for _, invalid := range []string{"serial 5", "serial: five", "serial: 9-2", "host: example.com", "key: nope"} {
+		_, err = ParseRevocationList([]byte(invalid))
+		assert.NotNil(t, err, "%q should be invalid", invalid)
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	ca := newSigner(t)
+	user := newSigner(t)
+
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revoked")
+
+	ioutil.WriteFile(path, []byte("serial: 1\n"), 0600)
+	rl, err := LoadRevocationList(path)
+	if !assert.Nil(t, err, "revocation list should be loaded") {
+		return
+	}
+	assert.True(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 1, "jonny")))
+
+	// Reloading replaces the entries
+	ioutil.WriteFile(path, []byte("serial: 2\n"), 0600)
+	assert.Nil(t, rl.Load(path))
+	assert.False(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 1, "jonny")))
+	assert.True(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 2, "jonny")))
+
+	// Invalid files leave the list unchanged
+	ioutil.WriteFile(path, []byte("bogus"), 0600)
+	assert.NotNil(t, rl.Load(path))
+	assert.True(t, rl.IsRevoked(newCert(t, ca, user.PublicKey(), 2, "jonny")))
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions set in the ssh.Permissions by CertAuthority and AuthorizedKeys.
+// The permit-* extensions have the same meaning as in OpenSSH certificates.
+const (
+	PermitPortForwarding  = "permit-port-forwarding"
+	PermitPty             = "permit-pty"
+	PermitAgentForwarding = "permit-agent-forwarding"
+	PermitX11Forwarding   = "permit-X11-forwarding"
+	PermitUserRC          = "permit-user-rc"
+
+	// RestrictExtension marks permissions in which only the permit-*
+	// extensions present are allowed.
+	RestrictExtension = "restrict"
+
+	// PermitOpenExtension lists the host:port destinations the user may
+	// open with local port forwarding, separated by commas.
+	PermitOpenExtension = "permitopen"
+
+	// EnvironmentExtension lists NAME=value pairs to add to the
+	// environment of sessions, separated by newlines.
+	EnvironmentExtension = "environment"
+)
+
+// permits lists every permit-* extension.
+var permits = []string{
+	PermitPortForwarding,
+	PermitPty,
+	PermitAgentForwarding,
+	PermitX11Forwarding,
+	PermitUserRC,
+}
+
+// Permitted returns true if the permissions allow the feature named by a
+// permit-* extension. Permissions without the RestrictExtension, such as those
+// returned by a password callback, allow every feature. Sessions refuse
+// pseudo-terminals unless PermitPty is permitted.
+func Permitted(perms *ssh.Permissions, permit string) bool {
+	if perms == nil || perms.Extensions == nil {
+		return true
+	}
+	if _, ok := perms.Extensions[RestrictExtension]; !ok {
+		return true
+	}
+	_, ok := perms.Extensions[permit]
+	return ok
+}
+
+// PermitOpen returns the host:port destinations allowed for local port
+// forwarding. A nil slice means no destinations were listed.
+func PermitOpen(perms *ssh.Permissions) []string {
+	return splitExtension(perms, PermitOpenExtension, ",")
+}
+
+// Environment returns the NAME=value pairs to add to the environment of
+// sessions. Sessions add them.
+func Environment(perms *ssh.Permissions) []string {
+	return splitExtension(perms, EnvironmentExtension, "\n")
+}
+
+func splitExtension(perms *ssh.Permissions, name, sep string) []string {
+	if perms == nil || perms.Extensions[name] == "" {
+		return nil
+	}
+	return strings.Split(perms.Extensions[name], sep)
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrInvalidCode is returned when a one-time code does not match.
+var ErrInvalidCode = errors.New("ssh: invalid verification code")
+
+// SecretStore looks up the TOTP secret for a user.
+type SecretStore interface {
+	Secret(user string) ([]byte, error)
+}
+
+// SecretStoreFunc adapts a function to the SecretStore interface.
+type SecretStoreFunc func(user string) ([]byte, error)
+
+// Secret calls the function.
+func (f SecretStoreFunc) Secret(user string) ([]byte, error) {
+	return f(user)
+}
+
+// StaticSecrets is a SecretStore backed by a map of users to secrets.
+type StaticSecrets map[string][]byte
+
+// Secret returns the secret for the user.
+func (s StaticSecrets) Secret(user string) ([]byte, error) {
+	secret, ok := s[user]
+	if !ok {
+		return nil, fmt.Errorf("ssh: no TOTP secret for %q", user)
+	}
+	return secret, nil
+}
+
+// DecodeSecret decodes a base32 secret as shown by authenticator apps. Spaces
+// and padding are optional.
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// TOTP verifies RFC 6238 time-based one-time codes using HMAC-SHA1. A code
+// can only be used once, so an observed code cannot be replayed.
+//
+// KeyboardInteractive can be used as the Config KeyboardInteractiveCallback.
+type TOTP struct {
+
+	// Secrets looks up the secret for each user.
+	Secrets SecretStore
+
+	// Digits is the length of the codes, at most 10. If zero, 6 is used.
+	Digits int
+
+	// Period is the time step, which may be under a second. If zero, 30
+	// seconds is used.
+	Period time.Duration
+
+	// Skew is the number of time steps before and after the current one
+	// which are also accepted, to allow for clock drift. If zero, no
+	// skew is allowed.
+	Skew int
+
+	// Prompt is shown to the user. If empty, "Verification code: " is used.
+	Prompt string
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu   sync.Mutex
+	used map[string]uint64
+}
+
+// Code returns the code for the secret at the given time.
+func (t *TOTP) Code(secret []byte, at time.Time) string {
+	return hotp(secret, t.counter(at), t.digits())
+}
+
+// Verify checks the code for the user.
+func (t *TOTP) Verify(user, code string) error {
+	secret, err := t.Secrets.Secret(user)
+	if err != nil {
+		return err
+	}
+
+	clock := t.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	now := t.counter(clock())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := -t.Skew; i <= t.Skew; i++ {
+		counter := now + uint64(i)
+		expected := hotp(secret, counter, t.digits())
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		// Refuse codes at or before the last one used
+		if last, ok := t.used[user]; ok && counter <= last {
+			return ErrInvalidCode
+		}
+		if t.used == nil {
+			t.used = make(map[string]uint64)
+		}
+		t.used[user] = counter
+		return nil
+	}
+	return ErrInvalidCode
+}
+
+// KeyboardInteractive prompts the user for a code and verifies it.
+func (t *TOTP) KeyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	prompt := t.Prompt
+	if prompt == "" {
+		prompt = "Verification code: "
+	}
+
+	answers, err := client(conn.User(), "", []string{prompt}, []bool{true})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, ErrInvalidCode
+	}
+
+	if err := t.Verify(conn.User(), strings.TrimSpace(answers[0])); err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{}, nil
+}
+
+// maxDigits is the longest code, as the truncated HMAC is below 2^31.
+const maxDigits = 10
+
+func (t *TOTP) digits() int {
+	if t.Digits <= 0 {
+		return 6
+	} else if t.Digits > maxDigits {
+		return maxDigits
+	}
+	return t.Digits
+}
+
+func (t *TOTP) counter(at time.Time) uint64 {
+	period := t.Period
+	if period <= 0 {
+		period = 30 * time.Second
+	}
+
+	// Whole seconds avoid the overflow of UnixNano after 2262
+	if period%time.Second == 0 {
+		return uint64(at.Unix() / int64(period/time.Second))
+	}
+	return uint64(at.UnixNano() / int64(period))
+}
+
+// hotp returns the RFC 4226 code for the counter.
+func hotp(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0F
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, uint64(code)%mod)
+}
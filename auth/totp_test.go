@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	totp := &TOTP{Digits: 8}
+
+	// Test vectors from RFC 6238 for HMAC-SHA1
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.code, totp.Code(secret, time.Unix(test.unix, 0)), "time %d", test.unix)
+	}
+
+	// Default length
+	assert.Equal(t, "287082", (&TOTP{}).Code(secret, time.Unix(59, 0)))
+
+	// Longer codes are capped and shorter periods are allowed
+	assert.Equal(t, "1094287082", (&TOTP{Digits: 12}).Code(secret, time.Unix(59, 0)))
+	short := &TOTP{Period: 500 * time.Millisecond}
+	assert.Equal(t, hotp(secret, 118, 6), short.Code(secret, time.Unix(59, 0)))
+	assert.Equal(t, hotp(secret, 119, 6), short.Code(secret, time.Unix(59, 600000000)))
+}
+
+func TestTOTPVerify(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	totp := &TOTP{
+		Secrets: StaticSecrets{"jonny": secret},
+		Skew:    1,
+		Clock:   func() time.Time { return now },
+	}
+
+	assert.Equal(t, ErrInvalidCode, totp.Verify("jonny", "000000"), "wrong code should be refused")
+	assert.NotNil(t, totp.Verify("hadji", totp.Code(secret, now)), "users without secrets should be refused")
+
+	// Codes from the previous step are accepted but cannot be replayed
+	previous := totp.Code(secret, now.Add(-30*time.Second))
+	assert.Nil(t, totp.Verify("jonny", previous), "previous code should be accepted")
+	assert.Equal(t, ErrInvalidCode, totp.Verify("jonny", previous), "code should not be replayed")
+	assert.Nil(t, totp.Verify("jonny", totp.Code(secret, now)), "current code should be accepted")
+	assert.Equal(t, ErrInvalidCode, totp.Verify("jonny", previous), "older code should be refused")
+
+	// Codes outside the skew are refused
+	assert.Equal(t, ErrInvalidCode, totp.Verify("jonny", totp.Code(secret, now.Add(time.Minute))))
+}
+
+func TestTOTPKeyboardInteractive(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	totp := &TOTP{
+		Secrets: SecretStoreFunc(func(user string) ([]byte, error) { return secret, nil }),
+		Clock:   func() time.Time { return now },
+	}
+
+	var questions []string
+	challenge := func(answer string) ssh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, q []string, echos []bool) ([]string, error) {
+			questions = q
+			return []string{answer}, nil
+		}
+	}
+
+	_, err := totp.KeyboardInteractive(connFor("jonny"), challenge("123456"))
+	assert.Equal(t, ErrInvalidCode, err, "wrong code should be refused")
+	assert.Equal(t, []string{"Verification code: "}, questions)
+
+	perms, err := totp.KeyboardInteractive(connFor("jonny"), challenge(totp.Code(secret, now)+"\n"))
+	assert.Nil(t, err, "code should be accepted")
+	assert.NotNil(t, perms)
+
+	failing := func(user, instruction string, q []string, echos []bool) ([]string, error) {
+		return nil, errors.New("disconnected")
+	}
+	_, err = totp.KeyboardInteractive(connFor("jonny"), failing)
+	assert.NotNil(t, err, "challenge errors should be returned")
+}
+
+func TestDecodeSecret(t *testing.T) {
+	secret, err := DecodeSecret("gezd gnbv gy3t qojq")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1234567890"), secret)
+
+	_, err = DecodeSecret("not base32!")
+	assert.NotNil(t, err)
+}
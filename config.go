@@ -1,6 +1,8 @@
 package sshh
 
 import (
+	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -16,27 +18,111 @@ type Config struct {
 	// Context allows for lifecycle management of the server.
 	Context context.Context
 
-	// Deadline is the maximum time the listener will block
-	// between connections. As a consequence, this duration
-	// also sets the max length of time the SSH server will
-	// be unresponsive before shutting down.
+	// Deadline is no longer used. The listeners are closed as soon as
+	// the server is stopped, so accepts no longer need to time out.
 	Deadline time.Duration
 
+	// MaxAcceptBackoff caps the delay between retries when a listener
+	// returns a temporary error, such as running out of file descriptors.
+	// The delay starts at 5ms and doubles on every failure. If zero, the
+	// delay is capped at one second.
+	MaxAcceptBackoff time.Duration
+
+	// HandshakeTimeout closes connections which have not finished the
+	// handshake and authentication in time, like the OpenSSH
+	// LoginGraceTime. If zero, two minutes is used. A negative value
+	// disables it.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a connection once it has had no channel activity
+	// for the given duration. Opening a channel, channel requests and data
+	// read or written on any channel count as activity, keepalives do
+	// not. A zero value keeps idle connections open until the client
+	// disconnects.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes connections which have been open for the given
+	// duration, whatever their activity. A zero value means no limit.
+	MaxLifetime time.Duration
+
+	// KeepAliveInterval, if non-zero, sends a keepalive@openssh.com
+	// request to the client whenever the interval passes, like the
+	// OpenSSH ClientAliveInterval. The connection is closed once
+	// KeepAliveCountMax requests in a row have gone unanswered.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveCountMax is the number of unanswered keepalives which
+	// close the connection. If zero, 3 is used.
+	KeepAliveCountMax int
+
+	// GracePeriod is how long Stop waits for open connections to finish
+	// their channels before closing them. A zero value closes all
+	// connections immediately.
+	GracePeriod time.Duration
+
+	// MaxConnections caps the number of open connections. Zero means no
+	// limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP caps the number of open connections from one
+	// source address. Zero means no limit.
+	MaxConnectionsPerIP int
+
+	// MaxSessionsPerUser caps the number of authenticated connections of
+	// one user. Zero means no limit.
+	MaxSessionsPerUser int
+
+	// MaxStartups caps the number of connections which have not finished
+	// authenticating, like the OpenSSH option of the same name. Zero means
+	// no limit.
+	MaxStartups int
+
+	// ProxyProtocol enables parsing of PROXY protocol v1 and v2 headers
+	// sent by load balancers such as HAProxy or AWS NLB. The client
+	// address from the header is then reported by the connection.
+	ProxyProtocol bool
+
+	// TrustedProxies lists the CIDR ranges PROXY headers are accepted
+	// from when ProxyProtocol is enabled, and must not be empty then.
+	// Connections from these sources must send a header. Connections from
+	// any other source are handled as direct connections.
+	TrustedProxies []string
+
 	// Dispatcher handles all open channel requests and dispatches them to a handler.
 	Dispatcher Dispatcher
 
 	// Consumer processes all global ssh.Requests for the life of the connection.
+	// It may implement ConnRequestConsumer to get the connection as well.
 	Consumer RequestConsumer
 
-	// Logger logs errors and debug output for the SSH server.
+	// Logger logs errors and debug output for the SSH server. It is required.
 	Logger log.Logger
 
 	// Bind specifies the Bind address the SSH server will listen on.
+	// It may be empty if Listeners are provided.
 	Bind string
 
+	// Listeners are accepted from in addition to the Bind address. Any
+	// net.Listener can be used, such as a Unix domain socket or a socket
+	// passed in by systemd. The server closes them when it is stopped.
+	Listeners []net.Listener
+
 	// PrivateKey is added to the SSH config as a host key.
 	PrivateKey ssh.Signer
 
+	// HostKeys are added to the SSH config along with the PrivateKey, so
+	// that RSA and ECDSA keys can be served together. Only one key per
+	// algorithm is used. See LoadHostKeys to read them from a directory.
+	// Ed25519 keys are not supported by the vendored SSH package.
+	HostKeys []ssh.Signer
+
+	// HostKeyAlgorithms, if non-empty, restricts the host keys offered to
+	// clients to the given algorithms, such as ssh.KeyAlgoECDSA256, in the
+	// order given. Clients choose the first of their own algorithms which
+	// the server offers, so leaving an algorithm out is the only way to
+	// stop clients from using it.
+	HostKeyAlgorithms []string
+
 	// AuthLogCallback, if non-nil, is called to log all authentication
 	// attempts.
 	AuthLogCallback func(conn ssh.ConnMetadata, method string, err error)
@@ -50,8 +136,20 @@ type Config struct {
 	// valid for the given user. For example, see CertChecker.Authenticate.
 	PublicKeyCallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)
 
+	// KeyboardInteractiveCallback, if non-nil, is called when a client
+	// attempts keyboard-interactive authentication, such as a one-time
+	// code. The challenge can be called any number of times.
+	KeyboardInteractiveCallback func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+
+	// AuthLimiter, if non-nil, bans addresses and users after too many
+	// failed authentication attempts.
+	AuthLimiter *AuthLimiter
+
 	// sshConfig is used to verify incoming connections.
 	sshConfig *ssh.ServerConfig
+
+	// trustedProxies are the parsed TrustedProxies.
+	trustedProxies []*net.IPNet
 }
 
 // SSHConfig returns an SSH server configuration. If the AuthLogCallback is nil at the
@@ -60,11 +158,75 @@ func (c *Config) SSHConfig() *ssh.ServerConfig {
 
 	// Create server config
 	sshConfig := &ssh.ServerConfig{
-		NoClientAuth:      false,
-		PasswordCallback:  c.PasswordCallback,
-		PublicKeyCallback: c.PublicKeyCallback,
-		AuthLogCallback:   c.AuthLogCallback,
+		NoClientAuth:                false,
+		PasswordCallback:            c.PasswordCallback,
+		PublicKeyCallback:           c.PublicKeyCallback,
+		KeyboardInteractiveCallback: c.KeyboardInteractiveCallback,
+		AuthLogCallback:             c.AuthLogCallback,
+	}
+	for _, key := range c.hostKeys() {
+		sshConfig.AddHostKey(key)
+	}
+	if c.AuthLimiter != nil {
+		c.AuthLimiter.wrap(sshConfig)
 	}
-	sshConfig.AddHostKey(c.PrivateKey)
 	return sshConfig
 }
+
+// prepare validates the config and creates the SSH server config and trusted proxy
+// ranges used by new connections.
+func (c *Config) prepare() error {
+
+	// Validate the host keys
+	if len(c.hostKeys()) == 0 {
+		return fmt.Errorf("ssh server: No host keys")
+	}
+
+	// Every connection logs to the Logger
+	if c.Logger == nil {
+		return fmt.Errorf("ssh server: No logger")
+	}
+
+	// Parse trusted proxy ranges
+	trustedProxies, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return err
+	} else if c.ProxyProtocol && len(trustedProxies) == 0 {
+		return fmt.Errorf("ssh server: ProxyProtocol requires TrustedProxies")
+	}
+
+	c.trustedProxies = trustedProxies
+	c.sshConfig = c.SSHConfig()
+	return nil
+}
+
+// hostKeys returns the PrivateKey and HostKeys, filtered and sorted by the
+// HostKeyAlgorithms if any are given.
+func (c *Config) hostKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	if c.PrivateKey != nil {
+		keys = append(keys, c.PrivateKey)
+	}
+	keys = append(keys, c.HostKeys...)
+	if len(c.HostKeyAlgorithms) == 0 {
+		return keys
+	}
+
+	var sorted []ssh.Signer
+	for _, algo := range c.HostKeyAlgorithms {
+		for _, key := range keys {
+			if key.PublicKey().Type() == algo {
+				sorted = append(sorted, key)
+			}
+		}
+	}
+	return sorted
+}
+
+// maxAcceptBackoff returns the MaxAcceptBackoff, or the default if it is not set.
+func (c *Config) maxAcceptBackoff() time.Duration {
+	if c.MaxAcceptBackoff <= 0 {
+		return defaultMaxAcceptBackoff
+	}
+	return c.MaxAcceptBackoff
+}
@@ -170,7 +170,6 @@ type BadHandler struct {
 }
 
 func (BadHandler) Handle(ctx *router.UrlContext) error {
-	defer ctx.Channel.Close()
 	return fmt.Errorf("an error occurred")
 }
 
@@ -179,6 +178,9 @@ func TestConfig(t *testing.T) {
 	var authLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
 		authLogCalled = true
 	}
+	var keyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		return nil, fmt.Errorf("Unauthorized")
+	}
 
 	// Create logger
 	writer := log.NewConcurrentWriter(ioutil.Discard)
@@ -187,7 +189,7 @@ func TestConfig(t *testing.T) {
 	// Get signer
 	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
 	if err != nil {
-		t.Fatalf("Private key could not be parsed", err.Error())
+		t.Fatal("Private key could not be parsed", err.Error())
 	}
 
 	r := router.New(logger, nil, nil)
@@ -208,6 +210,8 @@ func TestConfig(t *testing.T) {
 		AuthLogCallback:   authLogCallback,
 		PasswordCallback:  passwordCallback,
 		PublicKeyCallback: publicKeyCallback,
+
+		KeyboardInteractiveCallback: keyboardInteractiveCallback,
 	}
 
 	// Assertions
@@ -219,7 +223,9 @@ func TestConfig(t *testing.T) {
 	assert.NotNil(t, c, "SSH config should not be nil")
 	assert.Equal(t, passwordCallback, c.PasswordCallback, "PasswordCallback should use the one we passed in")
 	assert.Equal(t, publicKeyCallback, c.PublicKeyCallback, "PublicKeyCallback should use the one we passed in")
+	assert.Equal(t, keyboardInteractiveCallback, c.KeyboardInteractiveCallback, "KeyboardInteractiveCallback should use the one we passed in")
 	assert.Equal(t, authLogCallback, c.AuthLogCallback, "AuthLogCallback should use the one we passed in")
+	assert.False(t, authLogCalled, "AuthLogCallback should not be called while creating the config")
 
 	// // Test Handlers
 	// h, ok := cfg.Handler("echo")
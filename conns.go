@@ -0,0 +1,234 @@
+package sshh
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ServerStats is a snapshot of the counters for an SSHServer.
+type ServerStats struct {
+
+	// OpenConnections is the number of connections currently open.
+	OpenConnections int
+
+	// AcceptedConnections is the total number of connections accepted.
+	AcceptedConnections uint64
+
+	// AcceptErrors is the total number of failed accepts, excluding
+	// those caused by closing the listeners.
+	AcceptErrors uint64
+
+	// AcceptBackoffs is the total number of times a listener backed off
+	// after a temporary error.
+	AcceptBackoffs uint64
+
+	// RefusedConnections is the total number of connections refused
+	// because of a connection limit.
+	RefusedConnections uint64
+
+	// Handshakes is the number of connections which have not finished
+	// authenticating.
+	Handshakes int
+
+	// ConnectionsByIP is the number of open connections from each
+	// source address.
+	ConnectionsByIP map[string]int
+
+	// SessionsByUser is the number of authenticated connections of each
+	// user.
+	SessionsByUser map[string]int
+}
+
+// connLimits are the connection limits from the Config. Zero means no limit.
+type connLimits struct {
+	total    int
+	perIP    int
+	perUser  int
+	startups int
+}
+
+// connTracker keeps track of the open connections for an SSHServer and
+// signals them when the server starts draining.
+type connTracker struct {
+
+	// counters reported by stats, kept first for 64-bit alignment
+	acceptedCount uint64
+	acceptErrors  uint64
+	backoffs      uint64
+	refused       uint64
+
+	wg    sync.WaitGroup
+	count int32
+
+	// listeners is used to wait until all the listeners have exited
+	listeners sync.WaitGroup
+
+	// mu guards the counts used by the connection limits
+	mu         sync.Mutex
+	admitted   int
+	handshakes int
+	byIP       map[string]int
+	byUser     map[string]int
+
+	// quit is closed to stop the listener
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// drain is closed to tell all connections to finish up
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		quit:   make(chan struct{}),
+		drain:  make(chan struct{}),
+		byIP:   make(map[string]int),
+		byUser: make(map[string]int),
+	}
+}
+
+// add registers a new connection. It must be called before the connection
+// task is spawned.
+func (t *connTracker) add() {
+	t.wg.Add(1)
+	atomic.AddInt32(&t.count, 1)
+}
+
+// done unregisters a connection once it has been closed.
+func (t *connTracker) done() {
+	atomic.AddInt32(&t.count, -1)
+	t.wg.Done()
+}
+
+// open returns the number of open connections.
+func (t *connTracker) open() int {
+	return int(atomic.LoadInt32(&t.count))
+}
+
+// accepted counts a new connection from a listener.
+func (t *connTracker) accepted() {
+	atomic.AddUint64(&t.acceptedCount, 1)
+}
+
+// acceptFailed counts a failed accept.
+func (t *connTracker) acceptFailed() {
+	atomic.AddUint64(&t.acceptErrors, 1)
+}
+
+// backedOff counts an accept back-off.
+func (t *connTracker) backedOff() {
+	atomic.AddUint64(&t.backoffs, 1)
+}
+
+// admit registers a connection from the address which is starting its
+// handshake. If a limit is reached the connection is not registered and the
+// reason is returned. The limits are checked and the counts updated under the
+// same lock, so concurrent connections cannot exceed them.
+func (t *connTracker) admit(ip string, limits connLimits) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reason string
+	switch {
+	case limits.total > 0 && t.admitted >= limits.total:
+		reason = "too many connections"
+	case limits.startups > 0 && t.handshakes >= limits.startups:
+		reason = "too many unauthenticated connections"
+	case limits.perIP > 0 && t.byIP[ip] >= limits.perIP:
+		reason = "too many connections from " + ip
+	}
+	if reason != "" {
+		atomic.AddUint64(&t.refused, 1)
+		return reason
+	}
+
+	t.admitted++
+	t.handshakes++
+	t.byIP[ip]++
+	return ""
+}
+
+// handshakeDone unregisters a connection which finished authenticating or
+// failed to.
+func (t *connTracker) handshakeDone() {
+	t.mu.Lock()
+	t.handshakes--
+	t.mu.Unlock()
+}
+
+// release unregisters a connection admitted from the address.
+func (t *connTracker) release(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.admitted--
+	if t.byIP[ip]--; t.byIP[ip] <= 0 {
+		delete(t.byIP, ip)
+	}
+}
+
+// addUser registers an authenticated connection for the user. It returns
+// false if the user already has the maximum number of connections.
+func (t *connTracker) addUser(user string, max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && t.byUser[user] >= max {
+		atomic.AddUint64(&t.refused, 1)
+		return false
+	}
+	t.byUser[user]++
+	return true
+}
+
+// removeUser unregisters an authenticated connection for the user.
+func (t *connTracker) removeUser(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byUser[user]--; t.byUser[user] <= 0 {
+		delete(t.byUser, user)
+	}
+}
+
+// stats returns a snapshot of the counters.
+func (t *connTracker) stats() ServerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := ServerStats{
+		OpenConnections:     t.open(),
+		AcceptedConnections: atomic.LoadUint64(&t.acceptedCount),
+		AcceptErrors:        atomic.LoadUint64(&t.acceptErrors),
+		AcceptBackoffs:      atomic.LoadUint64(&t.backoffs),
+		RefusedConnections:  atomic.LoadUint64(&t.refused),
+		Handshakes:          t.handshakes,
+		ConnectionsByIP:     make(map[string]int, len(t.byIP)),
+		SessionsByUser:      make(map[string]int, len(t.byUser)),
+	}
+	for ip, n := range t.byIP {
+		stats.ConnectionsByIP[ip] = n
+	}
+	for user, n := range t.byUser {
+		stats.SessionsByUser[user] = n
+	}
+	return stats
+}
+
+// stopListening closes the quit channel. It is safe to call more than once.
+func (t *connTracker) stopListening() {
+	t.quitOnce.Do(func() { close(t.quit) })
+}
+
+// startDraining closes the drain channel. It is safe to call more than once.
+func (t *connTracker) startDraining() {
+	t.drainOnce.Do(func() { close(t.drain) })
+}
+
+// wait returns a channel which is closed once all connections are closed.
+func (t *connTracker) wait() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
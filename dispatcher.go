@@ -1,7 +1,6 @@
 package sshh
 
 import (
-	"fmt"
 	"net/url"
 
 	"github.com/blacklabeldata/sshh/router"
@@ -11,6 +10,9 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Dispatcher handles a new channel request for an SSH connection. The
+// connection is owned by the server and may carry several channels at once,
+// so a Dispatcher must not close it.
 type Dispatcher interface {
 	Dispatch(context.Context, *ssh.ServerConn, ssh.NewChannel)
 }
@@ -19,59 +21,79 @@ type SimpleDispatcher struct {
 	Logger       log.Logger
 	Handlers     map[string]Handler
 	PanicHandler PanicHandler
-	NotFound     Handler
-}
 
-func (u *SimpleDispatcher) Dispatch(c context.Context, conn *ssh.ServerConn, ch ssh.NewChannel) {
-	defer conn.Close()
+	// NotFound handles the channel types without a handler, like the other
+	// handlers. If nil, these channels are rejected as unknown.
+	NotFound Handler
 
-	var ctx *Context
-	if u.PanicHandler != nil {
-		if rcv := recover(); rcv != nil {
-			u.PanicHandler.Handle(ctx, rcv)
-		}
-	}
+	// Middleware wraps every handler, the first one outermost.
+	Middleware []Middleware
+
+	// ErrorStatus is the exit status sent when a handler returns an error.
+	// If zero, 1 is used.
+	ErrorStatus int
+}
 
+func (u *SimpleDispatcher) Dispatch(c context.Context, conn *ssh.ServerConn, ch ssh.NewChannel) {
 	// Get channel type
 	chType := ch.ChannelType()
 
 	handler, ok := u.Handlers[chType]
-	if !ok {
+	if !ok && u.NotFound != nil {
+		handler = u.NotFound
+	} else if !ok {
+		u.Logger.Info("UnknownChannelType", "type", chType)
+		ch.Reject(ssh.UnknownChannelType, chType)
 		return
 	}
 
-	// Otherwise, accept the channel
-	channel, requests, err := ch.Accept()
-	if err != nil {
-		u.Logger.Warn("Error creating channel", "type", chType, "err", err)
-		ch.Reject(ChannelAcceptError, chType)
-		return
-	}
+	dispatch(c, conn, ch, chain(accepting(handler), u.Middleware), u.Logger, u.PanicHandler, u.ErrorStatus)
+}
 
-	// Handle the channel
-	ctx = &Context{
-		Context:  c,
-		Channel:  channel,
-		Requests: requests,
+// Use adds middleware to every handler. It must not be called while handling
+// channels.
+func (u *SimpleDispatcher) Use(mw ...Middleware) {
+	u.Middleware = append(u.Middleware, mw...)
+}
+
+// dispatch runs the handler of a channel and reports its result.
+func dispatch(c context.Context, conn *ssh.ServerConn, ch ssh.NewChannel, handler Handler, logger log.Logger, panicHandler PanicHandler, status int) {
+	ctx := &Context{
+		ChannelType: ch.ChannelType(),
+		Context:     c,
+		Conn:        conn,
+		Acceptor:    router.Acceptor{NewChannel: ch},
 	}
-	err = handler.Handle(ctx)
-	if err != nil {
-		u.Logger.Warn("Error handling channel", "type", chType, "err", err)
-		ch.Reject(ChannelHandleError, fmt.Sprintf("error handling channel: %s", err.Error()))
-		return
+	err := handle(func() error { return handler.Handle(ctx) })
+	if p, ok := err.(*router.PanicError); ok && panicHandler != nil {
+		panicHandler.Handle(ctx, p.Value)
 	}
+	logResult(logger, ctx.ChannelType, err)
+	finish(&ctx.Acceptor, ctx.ChannelType, err, status)
 }
 
 type UrlDispatcher struct {
 	Logger log.Logger
 	Router *router.Router
+
+	// Handlers handles the channel types which are not URIs, such as
+	// direct-tcpip, before they are routed. Like the handlers of the
+	// SimpleDispatcher, their channels are accepted unless they accept them
+	// themselves.
+	Handlers map[string]Handler
+
+	// ErrorStatus is the exit status sent when a handler returns an error.
+	// If zero, 1 is used.
+	ErrorStatus int
 }
 
 func (u *UrlDispatcher) Dispatch(c context.Context, conn *ssh.ServerConn, ch ssh.NewChannel) {
-	defer conn.Close()
-
 	// Get channel type
 	chType := ch.ChannelType()
+	if handler, ok := u.Handlers[chType]; ok {
+		dispatch(c, conn, ch, accepting(handler), u.Logger, nil, u.ErrorStatus)
+		return
+	}
 
 	// Parse channel URI
 	uri, err := url.ParseRequestURI(chType)
@@ -99,27 +121,47 @@ func (u *UrlDispatcher) Dispatch(c context.Context, conn *ssh.ServerConn, ch ssh
 		return
 	}
 
-	// Otherwise, accept the channel
-	channel, requests, err := ch.Accept()
-	if err != nil {
-		u.Logger.Warn("Error creating channel", "type", chType, "err", err)
-		ch.Reject(ChannelAcceptError, chType)
-		return
-	}
-
-	// Handle the channel
-	err = u.Router.Handle(&router.UrlContext{
+	// Handle the channel, accepted unless the route accepts it itself
+	ctx := &router.UrlContext{
 		Path:     uri.Path,
 		Context:  c,
+		Conn:     conn,
 		Values:   values,
-		Channel:  channel,
-		Requests: requests,
-	})
-	if err != nil {
-		u.Logger.Warn("Error handling channel", "type", chType, "err", err)
-		ch.Reject(ChannelHandleError, fmt.Sprintf("error handling channel: %s", err.Error()))
+		Acceptor: router.Acceptor{NewChannel: ch},
+	}
+	err = handle(func() error { return u.Router.Handle(ctx) })
+	if ctx.Channel == nil && !ctx.Rejected() && rejectInvalid(chType, err, ch, u.Logger) {
 		return
 	}
+	logResult(u.Logger, chType, err)
+	finish(&ctx.Acceptor, chType, err, u.ErrorStatus)
+}
+
+// logResult logs handler errors other than exit statuses.
+func logResult(logger log.Logger, chType string, err error) {
+	switch err.(type) {
+	case nil:
+	case *ExitError:
+		logger.Debug("Channel exited", "type", chType, "err", err)
+	default:
+		logger.Warn("Error handling channel", "type", chType, "err", err)
+	}
+}
+
+// rejectInvalid rejects channels whose parameters or query values do not match
+// their constraints, as unknown channels or invalid query values.
+func rejectInvalid(chType string, err error, ch ssh.NewChannel, logger log.Logger) bool {
+	switch err.(type) {
+	case *router.ErrInvalidParam:
+		logger.Info("UnknownChannelType", "type", chType, "err", err)
+		ch.Reject(ssh.UnknownChannelType, chType)
+	case *router.ErrInvalidValue:
+		logger.Info("Invalid query params", "type", chType, "err", err)
+		ch.Reject(InvalidQueryParams, err.Error())
+	default:
+		return false
+	}
+	return true
 }
 
 func reject(chType string, uri *url.URL, ch ssh.NewChannel, logger log.Logger) bool {
@@ -0,0 +1,32 @@
+package sshh
+
+import "golang.org/x/net/context"
+
+// ShutdownRequest is the global request type sent to every connected client
+// when the server starts draining. The payload is empty and no reply is
+// expected, so clients which do not understand it can safely ignore it.
+const ShutdownRequest = "shutdown@blacklabeldata.com"
+
+// ShutdownStats reports the outcome of a graceful shutdown.
+type ShutdownStats struct {
+
+	// Drained is the number of connections which closed on their own
+	// before the shutdown deadline.
+	Drained int
+
+	// Killed is the number of connections which were still open at the
+	// deadline and had to be forcibly closed.
+	Killed int
+}
+
+type drainKey struct{}
+
+// DrainNotify returns a channel which is closed when the server starts a
+// graceful shutdown. Handlers can use it to finish their work early. The
+// returned channel is nil if the context was not created by an SSHServer.
+func DrainNotify(c context.Context) <-chan struct{} {
+	if ch, ok := c.Value(drainKey{}).(chan struct{}); ok {
+		return ch
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package sshh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/sshh/router"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// waitRoute routes /wait to the handler of a drain test.
+func waitRoute(handler router.HandlerFunc) func(*Config) {
+	return func(cfg *Config) {
+		r := router.New(log.NullLog, nil, nil)
+		r.RegisterFunc("/wait", handler)
+		cfg.Dispatcher = &UrlDispatcher{Router: r, Logger: log.NullLog}
+	}
+}
+
+func openDrainChannel(t *testing.T, addr string) *ssh.Client {
+	config := &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	}
+
+	// Create client connection
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Open channel
+	_, requests, err := client.OpenChannel("/wait", []byte{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go ssh.DiscardRequests(requests)
+	return client
+}
+
+func TestShutdownDrained(t *testing.T) {
+	server := startServer(t, ":9023", waitRoute(func(ctx *router.UrlContext) error {
+		defer ctx.Channel.Close()
+
+		// Finish as soon as the server starts draining
+		<-DrainNotify(ctx.Context)
+		return nil
+	}))
+
+	client := openDrainChannel(t, "127.0.0.1:9023")
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stats, err := server.Shutdown(ctx)
+	assert.Nil(t, err, "shutdown should complete before the deadline")
+	assert.Equal(t, 1, stats.Drained, "connection should have been drained")
+	assert.Equal(t, 0, stats.Killed, "no connections should have been killed")
+
+	// New connections should be refused
+	_, err = ssh.Dial("tcp", "127.0.0.1:9023", &ssh.ClientConfig{User: "jonny.quest"})
+	assert.NotNil(t, err, "listener should be closed")
+}
+
+func TestShutdownKilled(t *testing.T) {
+	server := startServer(t, ":9024", waitRoute(func(ctx *router.UrlContext) error {
+		defer ctx.Channel.Close()
+
+		// Ignore the drain notice
+		<-ctx.Context.Done()
+		return nil
+	}))
+
+	client := openDrainChannel(t, "127.0.0.1:9024")
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stats, err := server.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "shutdown should hit the deadline")
+	assert.Equal(t, 0, stats.Drained, "no connections should have been drained")
+	assert.Equal(t, 1, stats.Killed, "connection should have been killed")
+}
+
+func TestDrainNotifyWithoutServer(t *testing.T) {
+	assert.Nil(t, DrainNotify(context.Background()), "context without a server should have no drain channel")
+}
@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/blacklabeldata/sshh"
 	log "github.com/mgutz/logxi/v1"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
 )
 
 var privateKey = `
@@ -43,11 +43,14 @@ func main() {
 
 	// Setup server config
 	config := sshh.Config{
-		Deadline: time.Second,
-		Logger:   logger,
-		Bind:     ":9022",
-		Handlers: map[string]sshh.SSHHandler{
-			"session": NewShellHandler(logger),
+		Context: context.Background(),
+		Logger:  logger,
+		Bind:    ":9022",
+		Dispatcher: &sshh.SimpleDispatcher{
+			Logger: logger,
+			Handlers: map[string]sshh.Handler{
+				"session": NewShellHandler(logger),
+			},
 		},
 		PrivateKey: privateKey,
 		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (perm *ssh.Permissions, err error) {
@@ -75,7 +78,7 @@ func main() {
 	}
 
 	// Create SSH server
-	sshServer, err := sshh.NewSSHServer(&config)
+	sshServer, err := sshh.New(&config)
 	if err != nil {
 		logger.Error("SSH Server could not be configured", "error", err.Error())
 		return
@@ -7,12 +7,11 @@ import (
 	log "github.com/mgutz/logxi/v1"
 
 	"github.com/blacklabeldata/sshh"
-	"golang.org/x/crypto/ssh"
+	"github.com/blacklabeldata/sshh/session"
 	"golang.org/x/crypto/ssh/terminal"
-	tomb "gopkg.in/tomb.v2"
 )
 
-func NewShellHandler(logger log.Logger) sshh.SSHHandler {
+func NewShellHandler(logger log.Logger) sshh.Handler {
 	return &shellHandler{logger}
 }
 
@@ -20,80 +19,46 @@ type shellHandler struct {
 	logger log.Logger
 }
 
-func (s *shellHandler) Handle(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
-	defer channel.Close()
-	s.logger.Info("WooHoo!!! Inside Handler!")
-
-	// Create tomb for terminal goroutines
-	var t tomb.Tomb
-
-	// Sessions have out-of-band requests such as "shell",
-	// "pty-req" and "env".  Here we handle only the
-	// "shell" request.
-	t.Go(func() error {
-	OUTER:
-		for {
-			select {
-			case <-parentTomb.Dying():
-				t.Kill(nil)
-				break OUTER
-			case req := <-requests:
-				if req == nil {
-					break OUTER
-				}
-
-				ok := false
-				switch req.Type {
-				case "shell":
-					ok = true
-
-					if len(req.Payload) > 0 {
-						// fmt.Println(string(req.Payload))
-
-						// We don't accept any
-						// commands, only the
-						// default shell.
-						ok = false
-					}
+func (s *shellHandler) Handle(ctx *sshh.Context) error {
+	sess := session.New(ctx.Channel, ctx.Requests, ctx.Conn.Permissions)
 
-				case "pty-req":
-					// Responding 'ok' here will let the client
-					// know we have a pty ready for input
-					ok = true
+	// Wait for the client to ask for a shell or a command
+	if err := sess.Start(); err != nil {
+		return nil
+	}
 
-					t.Go(func() error {
-						return s.startTerminal(t, sshConn, channel)
-					})
-				}
+	switch sess.Type() {
+	case session.ShellRequest:
+		s.startTerminal(ctx, sess)
+		return nil
+	case session.ExecRequest:
 
-				req.Reply(ok, nil)
-			}
-		}
+		// Echo the command back instead of running it
+		s.logger.Info("Command received", "command", sess.Command())
+		fmt.Fprintf(sess, "%s\r\n", sess.Command())
 		return nil
-	})
-	return t.Wait()
+	default:
+		fmt.Fprintf(sess.Stderr(), "subsystem %q is not supported\r\n", sess.Subsystem())
+		return &sshh.ExitError{Code: 1}
+	}
 }
 
-func (s *shellHandler) startTerminal(parentTomb tomb.Tomb, sshConn *ssh.ServerConn, channel ssh.Channel) error {
-	defer channel.Close()
-
+func (s *shellHandler) startTerminal(ctx *sshh.Context, sess *session.Session) {
 	prompt := ">>> "
-	term := terminal.NewTerminal(channel, prompt)
-
-	// // Try to make the terminal raw
-	// oldState, err := terminal.MakeRaw(0)
-	// if err != nil {
-	//     logger.Warn("Error making terminal raw: ", err.Error())
-	// }
-	// defer terminal.Restore(0, oldState)
-
-	// Get username
-	username, ok := sshConn.Permissions.Extensions["username"]
-	if !ok {
-		username = "user"
+	term := terminal.NewTerminal(sess, prompt)
+
+	// Keep the terminal size in sync with the client
+	if pty, ok := sess.Pty(); ok {
+		term.SetSize(int(pty.Window.Columns), int(pty.Window.Rows))
 	}
+	go func() {
+		for window := range sess.WindowChanges() {
+			term.SetSize(int(window.Columns), int(window.Rows))
+		}
+	}()
 
 	// Write ascii text
+	username := "user"
 	term.Write([]byte(fmt.Sprintf("\r\n Nice job, %s! You are connected!\r\n", username)))
 	defer term.Write([]byte(fmt.Sprintf("\r\nGoodbye, %s!\r\n", username)))
 
@@ -101,14 +66,12 @@ func (s *shellHandler) startTerminal(parentTomb tomb.Tomb, sshConn *ssh.ServerCo
 	for {
 
 		select {
-		case <-parentTomb.Dying():
-			return nil
+		case <-ctx.Context.Done():
+			return
 		default:
-			s.logger.Info("Reading line...")
 			input, err := term.ReadLine()
 			if err != nil {
-				fmt.Errorf("Readline() error")
-				return err
+				return
 			}
 
 			// Process line
@@ -117,16 +80,15 @@ func (s *shellHandler) startTerminal(parentTomb tomb.Tomb, sshConn *ssh.ServerCo
 
 				// Log input and handle exit requests
 				if line == "exit" || line == "quit" {
-					s.logger.Info("Closing connection")
-					return nil
+					s.logger.Info("Closing session")
+					return
 				}
 
 				// Echo input
-				channel.Write(term.Escape.Green)
-				channel.Write([]byte(line + "\r\n"))
-				channel.Write(term.Escape.Reset)
+				sess.Write(term.Escape.Green)
+				sess.Write([]byte(line + "\r\n"))
+				sess.Write(term.Escape.Reset)
 			}
 		}
 	}
-	return nil
 }
@@ -0,0 +1,79 @@
+package sshh
+
+import (
+	"fmt"
+
+	"github.com/blacklabeldata/sshh/router"
+	"github.com/blacklabeldata/sshh/session"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ExitError is returned by handlers to send an exit status other than zero.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// finish reports the result of a handler. If the handler accepted the
+// channel and did not close it, see exit. If the channel could not be
+// accepted, it is rejected with ChannelAcceptError. If the handler neither
+// accepted nor rejected it, it is rejected with ChannelHandleError. The
+// channel requests the handler did not read are refused.
+func finish(a *router.Acceptor, chType string, err error, status int) {
+	_, failed := err.(*router.AcceptError)
+	switch {
+	case a.Closed():
+	case a.Channel != nil:
+		exit(a.Channel, err, status)
+	case a.Rejected():
+	case failed:
+		a.Reject(ChannelAcceptError, chType)
+	case err != nil:
+		a.Reject(ChannelHandleError, err.Error())
+	default:
+		a.Reject(ChannelHandleError, "channel not accepted")
+	}
+
+	// Refuse the requests the handler left unread
+	if a.Requests != nil {
+		go ssh.DiscardRequests(a.Requests)
+	}
+}
+
+// exit reports the result of a handler on its accepted channel, then sends
+// EOF and closes the channel. A nil error sends exit-status 0, an ExitError
+// sends its code and a panic sends exit-signal ABRT. Any other error is
+// written to stderr and sends the status, or 1 if it is zero.
+func exit(channel ssh.Channel, err error, status int) {
+	switch e := err.(type) {
+	case nil:
+		session.Exit(channel, 0)
+	case *ExitError:
+		session.Exit(channel, e.Code)
+	case *router.PanicError:
+		session.ExitWithSignal(channel, session.ExitSignal{
+			Signal:  ssh.SIGABRT,
+			Message: e.Error(),
+		})
+	default:
+		if status == 0 {
+			status = 1
+		}
+		fmt.Fprintln(channel.Stderr(), err)
+		session.Exit(channel, status)
+	}
+}
+
+// handle runs the handler, turning a panic into a router.PanicError.
+func handle(fn func() error) (err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = &router.PanicError{Value: rcv}
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,126 @@
+package sshh
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	sshmocks "github.com/blacklabeldata/mockery/ssh"
+	"github.com/blacklabeldata/sshh/router"
+	"github.com/blacklabeldata/sshh/session"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+type panicRecorder struct {
+	value interface{}
+}
+
+func (p *panicRecorder) Handle(ctx *Context, rcv interface{}) {
+	p.value = rcv
+}
+
+func TestExitStatus(t *testing.T) {
+
+	// Each command returns a different result
+	panics := &panicRecorder{}
+	handler := HandlerFunc(func(ctx *Context) error {
+		sess := session.New(ctx.Channel, ctx.Requests, ctx.Conn.Permissions)
+		if err := sess.Start(); err != nil {
+			return err
+		}
+		switch sess.Command() {
+		case "exit 3":
+			return &ExitError{Code: 3}
+		case "fail":
+			return errors.New("failed")
+		case "panic":
+			panic("oops")
+		}
+		return nil
+	})
+
+	server := startServer(t, "127.0.0.1:9033", func(cfg *Config) {
+		cfg.Dispatcher = &SimpleDispatcher{
+			Logger:       log.NullLog,
+			Handlers:     map[string]Handler{"session": HandlerFunc(handler)},
+			PanicHandler: panics,
+			ErrorStatus:  2,
+		}
+	})
+	defer server.Stop()
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:9033", &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	var stderr bytes.Buffer
+	run := func(cmd string) error {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer sess.Close()
+		stderr.Reset()
+		sess.Stderr = &stderr
+		return sess.Run(cmd)
+	}
+
+	assert.Nil(t, run("true"), "nil should send exit status 0")
+
+	err = run("exit 3")
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, "exit status should be sent") {
+		assert.Equal(t, 3, exit.ExitStatus())
+	}
+
+	err = run("fail")
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, "exit status should be sent") {
+		assert.Equal(t, 2, exit.ExitStatus())
+	}
+	assert.Equal(t, "failed\n", stderr.String(), "error should be written to stderr")
+
+	err = run("panic")
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, "exit signal should be sent") {
+		assert.Equal(t, "ABRT", exit.Signal())
+		assert.Equal(t, "panic: oops", exit.Msg())
+	}
+	assert.Equal(t, "oops", panics.value, "PanicHandler should be called")
+}
+
+func TestClosedChannel(t *testing.T) {
+
+	// Handlers which close the channel get no exit status
+	dispatcher := &SimpleDispatcher{
+		Logger: log.NullLog,
+		Handlers: map[string]Handler{
+			"direct-tcpip": HandlerFunc(func(ctx *Context) error {
+				return ctx.Close()
+			}),
+		},
+	}
+
+	c := &sshmocks.MockChannel{}
+	c.On("Close").Return(nil)
+	ch := &sshmocks.MockNewChannel{TypeName: "direct-tcpip", Channel: c}
+	ch.On("ChannelType").Return("direct-tcpip")
+	ch.On("Accept").Return(c, nil, nil)
+
+	dispatcher.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+	c.AssertNumberOfCalls(t, "Close", 1)
+	c.AssertNotCalled(t, "SendRequest", session.ExitStatusRequest, false, []byte{0, 0, 0, 0})
+	c.AssertNotCalled(t, "CloseWrite")
+
+	// Channels which are not accepted cannot be closed
+	ctx := &Context{Acceptor: router.Acceptor{NewChannel: ch}}
+	assert.Equal(t, ErrChannelNotAccepted, ctx.Close())
+}
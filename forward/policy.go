@@ -0,0 +1,148 @@
+// Package forward implements SSH port forwarding for sshh servers. Every
+// forwarding request goes through a Policy, which can allow or deny it using
+// the permissions of the user.
+package forward
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/blacklabeldata/sshh/auth"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrProhibited is returned by policies which deny a forwarding request.
+var ErrProhibited = errors.New("forward: administratively prohibited")
+
+// privilegedPorts is the first port which is not privileged.
+const privilegedPorts = 1024
+
+// Request is a forwarding request checked by a Policy.
+type Request struct {
+
+	// Type is the channel or global request type, such as DirectTCPIP.
+	Type string
+
+	// User is the name of the user.
+	User string
+
+	// Permissions are the permissions of the user, if any.
+	Permissions *ssh.Permissions
+
+	// Host and Port are the destination of local forwarding, or the
+	// address to listen on for remote forwarding.
+	Host string
+	Port int
+
+	// Path is the socket path of Unix domain socket forwarding.
+	Path string
+}
+
+// Policy decides whether a forwarding request is allowed. It returns an error
+// to deny it, which is sent to the client.
+type Policy func(*Request) error
+
+// Permissions is the Policy used if none is set. It follows the permissions of
+// the user: forwarding, including Unix domain socket forwarding, must be allowed
+// by the permit-port-forwarding extension and local forwarding is limited to
+// the permitopen destinations, if any. Remote forwarding from privileged ports,
+// below 1024, is refused.
+func Permissions(r *Request) error {
+	if !auth.Permitted(r.Permissions, auth.PermitPortForwarding) {
+		return ErrProhibited
+	}
+	if r.Type == TCPIPForward && r.Port > 0 && r.Port < privilegedPorts {
+		return ErrProhibited
+	}
+	if r.Type == DirectTCPIP {
+		if open := auth.PermitOpen(r.Permissions); open != nil {
+			return PermitOpen(open...)(r)
+		}
+	}
+	return nil
+}
+
+// PermitOpen returns a Policy which only allows the host:port destinations
+// matching one of the patterns. Hosts may contain * and ? wildcards, and a port
+// of * matches any port, as with the OpenSSH permitopen option.
+func PermitOpen(patterns ...string) Policy {
+	return func(r *Request) error {
+		for _, pattern := range patterns {
+			if match(pattern, r.Host, r.Port) {
+				return nil
+			}
+		}
+		return ErrProhibited
+	}
+}
+
+// PermitPaths returns a Policy which only allows the socket paths matching one
+// of the patterns, as with path.Match. Requests without a path, such as TCP
+// forwarding, are allowed.
+func PermitPaths(patterns ...string) Policy {
+	return func(r *Request) error {
+		if r.Path == "" || matchPath(patterns, r.Path) {
+			return nil
+		}
+		return ErrProhibited
+	}
+}
+
+// All returns a Policy which allows a request only if all the policies do.
+func All(policies ...Policy) Policy {
+	return func(r *Request) error {
+		for _, policy := range policies {
+			if err := policy(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// match returns true if the host and port match a host:port pattern.
+func match(pattern, host string, port int) bool {
+	h, p, err := net.SplitHostPort(strings.TrimSpace(pattern))
+	if err != nil {
+		return false
+	}
+	if p != "*" && p != strconv.Itoa(port) {
+		return false
+	}
+	ok, err := path.Match(strings.ToLower(h), strings.ToLower(host))
+	return err == nil && ok
+}
+
+// cleanPath returns the cleaned path, or false if it is not absolute. Paths
+// are cleaned before being checked, so the path checked is the one used.
+func cleanPath(p string) (string, bool) {
+	if !path.IsAbs(p) {
+		return "", false
+	}
+	return path.Clean(p), true
+}
+
+// matchPath returns true if the absolute path matches one of the patterns.
+func matchPath(patterns []string, p string) bool {
+	p, ok := cleanPath(p)
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, p); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check runs the policy, or Permissions if it is nil.
+func check(policy Policy, r *Request) error {
+	if policy == nil {
+		policy = Permissions
+	}
+	return policy(r)
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/blacklabeldata/sshh/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPermitOpen(t *testing.T) {
+	policy := PermitOpen("db.internal:5432", "*.example.com:*", "[::1]:22")
+
+	tests := []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"db.internal", 5432, true},
+		{"DB.Internal", 5432, true},
+		{"db.internal", 5433, false},
+		{"www.example.com", 443, true},
+		{"example.com", 443, false},
+		{"::1", 22, true},
+		{"127.0.0.1", 22, false},
+	}
+	for _, test := range tests {
+		err := policy(&Request{Type: DirectTCPIP, Host: test.host, Port: test.port})
+		assert.Equal(t, test.allowed, err == nil, "%s:%d", test.host, test.port)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	req := func(perms *ssh.Permissions, host string, port int) *Request {
+		return &Request{Type: DirectTCPIP, Permissions: perms, Host: host, Port: port}
+	}
+
+	// Unrestricted permissions allow everything
+	assert.Nil(t, Permissions(req(nil, "localhost", 22)))
+
+	// Restricted permissions need permit-port-forwarding
+	restricted := &ssh.Permissions{Extensions: map[string]string{auth.RestrictExtension: ""}}
+	assert.Equal(t, ErrProhibited, Permissions(req(restricted, "localhost", 22)))
+
+	// The permitopen extension limits the destinations
+	permitted := &ssh.Permissions{Extensions: map[string]string{
+		auth.RestrictExtension:    "",
+		auth.PermitPortForwarding: "",
+		auth.PermitOpenExtension:  "localhost:22,db:*",
+	}}
+	assert.Nil(t, Permissions(req(permitted, "localhost", 22)))
+	assert.Nil(t, Permissions(req(permitted, "db", 5432)))
+	assert.Equal(t, ErrProhibited, Permissions(req(permitted, "localhost", 80)))
+
+	// Privileged ports cannot be listened on
+	listen := func(port int) *Request {
+		return &Request{Type: TCPIPForward, Permissions: permitted, Host: "localhost", Port: port}
+	}
+	assert.Equal(t, ErrProhibited, Permissions(listen(80)))
+	assert.Nil(t, Permissions(listen(8080)))
+	assert.Nil(t, Permissions(listen(0)), "allocated ports are not privileged")
+
+	// All needs every policy
+	policy := All(Permissions, PermitOpen("db:5432"))
+	assert.Nil(t, policy(req(permitted, "db", 5432)))
+	assert.Equal(t, ErrProhibited, policy(req(permitted, "db", 5433)))
+}
+
+func TestPermitPaths(t *testing.T) {
+	policy := PermitPaths("/var/run/docker.sock", "/tmp/*.sock")
+
+	assert.Nil(t, policy(&Request{Type: DirectStreamLocal, Path: "/var/run/docker.sock"}))
+	assert.Nil(t, policy(&Request{Type: DirectStreamLocal, Path: "/tmp/../tmp/db.sock"}))
+	assert.Equal(t, ErrProhibited, policy(&Request{Type: DirectStreamLocal, Path: "/tmp/sub/db.sock"}))
+	assert.Equal(t, ErrProhibited, policy(&Request{Type: DirectStreamLocal, Path: "tmp/db.sock"}))
+	assert.Nil(t, policy(&Request{Type: DirectTCPIP, Host: "localhost", Port: 22}), "TCP forwarding has no path")
+}
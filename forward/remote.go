@@ -0,0 +1,283 @@
+package forward
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// Remote port forwarding request and channel types, as defined in RFC 4254
+// section 7.
+const (
+	TCPIPForward       = "tcpip-forward"
+	CancelTCPIPForward = "cancel-tcpip-forward"
+	ForwardedTCPIP     = "forwarded-tcpip"
+)
+
+// Bind is the payload of tcpip-forward and cancel-tcpip-forward requests: the
+// address the client asks the server to listen on.
+type Bind struct {
+	Host string
+	Port uint32
+}
+
+// ParseTCPIPForward parses the payload of a tcpip-forward or
+// cancel-tcpip-forward request.
+func ParseTCPIPForward(payload []byte) (Bind, error) {
+	var b Bind
+	if err := ssh.Unmarshal(payload, &b); err != nil {
+		return b, ErrInvalidPayload
+	}
+	return b, nil
+}
+
+// RemoteForwarder is a RequestConsumer which handles remote port forwarding,
+// as used by ssh -R. For each tcpip-forward request allowed by the Policy it
+// listens on the requested address, and opens a forwarded-tcpip channel to the
+// client for every connection it accepts. The same goes for Unix domain
+// sockets with streamlocal-forward requests and forwarded-streamlocal
+// channels. The listeners are closed when the client cancels them or when the
+// connection ends. Other requests are refused.
+type RemoteForwarder struct {
+
+	// Policy allows or denies the addresses and socket paths to listen on.
+	// If nil, Permissions is used.
+	Policy Policy
+
+	// Listen opens the TCP listeners. If nil, net.Listen is used.
+	Listen func(network, address string) (net.Listener, error)
+
+	// GatewayPorts lets clients listen on any address, as with the OpenSSH
+	// option set to clientspecified; the empty host and * then mean every
+	// address. If false, clients may only listen on loopback: the empty
+	// host, * and localhost mean 127.0.0.1 and other addresses are refused.
+	GatewayPorts bool
+
+	// SocketPaths lists the socket paths which may be listened on, as
+	// path.Match patterns. If empty, no socket may be created.
+	SocketPaths []string
+
+	// SocketMode is the mode of the sockets. If zero, 0600 is used.
+	SocketMode os.FileMode
+
+	// UnlinkSocket removes a socket left at the path, such as by a server
+	// which crashed, before listening. Sockets are always removed when
+	// their listener is closed.
+	UnlinkSocket bool
+}
+
+// Consume refuses every request, as forwarding needs the connection.
+func (f *RemoteForwarder) Consume(requests <-chan *ssh.Request) {
+	ssh.DiscardRequests(requests)
+}
+
+// ConsumeConn handles the forwarding requests of the connection until it
+// ends.
+func (f *RemoteForwarder) ConsumeConn(c context.Context, conn *ssh.ServerConn, requests <-chan *ssh.Request) {
+	forwards := &forwards{listeners: make(map[string]net.Listener)}
+	defer forwards.closeAll()
+
+	for {
+		select {
+		case <-c.Done():
+			go ssh.DiscardRequests(requests)
+			return
+		case req, ok := <-requests:
+			if !ok {
+				return
+			}
+
+			var allowed bool
+			var payload []byte
+			switch req.Type {
+			case TCPIPForward:
+				payload, allowed = f.listen(c, conn, forwards, req.Payload)
+			case CancelTCPIPForward:
+				allowed = f.cancel(forwards, req.Payload)
+			case StreamLocalForward:
+				allowed = f.listenUnix(c, conn, forwards, req.Payload)
+			case CancelStreamLocalForward:
+				allowed = f.cancelUnix(forwards, req.Payload)
+			}
+			if req.WantReply {
+				req.Reply(allowed, payload)
+			}
+		}
+	}
+}
+
+// listen starts forwarding connections from the requested address. If port 0
+// was requested, the reply payload holds the allocated port.
+func (f *RemoteForwarder) listen(c context.Context, conn *ssh.ServerConn, forwards *forwards, payload []byte) ([]byte, bool) {
+	bind, err := ParseTCPIPForward(payload)
+	if err != nil {
+		return nil, false
+	}
+	req := &Request{
+		Type:        TCPIPForward,
+		User:        conn.User(),
+		Permissions: conn.Permissions,
+		Host:        bind.Host,
+		Port:        int(bind.Port),
+	}
+	host, ok := f.listenHost(bind.Host)
+	if !ok || check(f.Policy, req) != nil {
+		return nil, false
+	}
+
+	l, err := f.listener("tcp", net.JoinHostPort(host, strconv.Itoa(int(bind.Port))))
+	if err != nil {
+		return nil, false
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	if !forwards.add(net.JoinHostPort(bind.Host, strconv.Itoa(int(port))), l) {
+		l.Close()
+		return nil, false
+	}
+	go serve(c, conn, l, func(client net.Conn) (string, []byte) {
+		target := Target{Host: bind.Host, Port: port}
+		if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+			target.OriginatorHost, target.OriginatorPort = addr.IP.String(), uint32(addr.Port)
+		}
+		return ForwardedTCPIP, ssh.Marshal(&target)
+	})
+
+	if bind.Port == 0 {
+		return ssh.Marshal(&struct{ Port uint32 }{port}), true
+	}
+	return nil, true
+}
+
+// cancel stops forwarding connections from the address.
+func (f *RemoteForwarder) cancel(forwards *forwards, payload []byte) bool {
+	bind, err := ParseTCPIPForward(payload)
+	if err != nil {
+		return false
+	}
+	return forwards.remove(net.JoinHostPort(bind.Host, strconv.Itoa(int(bind.Port))))
+}
+
+// listenUnix starts forwarding connections from the requested socket path.
+func (f *RemoteForwarder) listenUnix(c context.Context, conn *ssh.ServerConn, forwards *forwards, payload []byte) bool {
+	requested, err := ParseStreamLocalForward(payload)
+	if err != nil {
+		return false
+	}
+	path, ok := cleanPath(requested)
+	if !ok {
+		return false
+	}
+	req := &Request{
+		Type:        StreamLocalForward,
+		User:        conn.User(),
+		Permissions: conn.Permissions,
+		Path:        path,
+	}
+	if !matchPath(f.SocketPaths, path) || check(f.Policy, req) != nil {
+		return false
+	}
+
+	l, err := listenUnix(path, f.SocketMode, f.UnlinkSocket)
+	if err != nil {
+		return false
+	}
+	if !forwards.add(path, l) {
+		l.Close()
+		return false
+	}
+	go serve(c, conn, l, func(net.Conn) (string, []byte) {
+		return ForwardedStreamLocal, ssh.Marshal(&forwardedStreamLocalMsg{Path: requested})
+	})
+	return true
+}
+
+// cancelUnix stops forwarding connections from the socket path.
+func (f *RemoteForwarder) cancelUnix(forwards *forwards, payload []byte) bool {
+	path, err := ParseStreamLocalForward(payload)
+	if err != nil {
+		return false
+	}
+	path, ok := cleanPath(path)
+	return ok && forwards.remove(path)
+}
+
+// serve opens a channel to the client for each accepted connection until the
+// listener is closed. The channel type and payload are given by open.
+func serve(c context.Context, conn *ssh.ServerConn, l net.Listener, open func(net.Conn) (string, []byte)) {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			chType, payload := open(client)
+			channel, requests, err := conn.OpenChannel(chType, payload)
+			if err != nil {
+				client.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			pipe(c, channel, client)
+		}()
+	}
+}
+
+func (f *RemoteForwarder) listener(network, address string) (net.Listener, error) {
+	if f.Listen != nil {
+		return f.Listen(network, address)
+	}
+	return net.Listen(network, address)
+}
+
+// listenHost returns the host to listen on for the requested host, or false if
+// the client may not listen on it, see GatewayPorts.
+func (f *RemoteForwarder) listenHost(host string) (string, bool) {
+	if f.GatewayPorts {
+		if host == "*" {
+			return "", true
+		}
+		return host, true
+	}
+
+	switch host {
+	case "", "*", "localhost":
+		return "127.0.0.1", true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return host, true
+	}
+	return "", false
+}
+
+// forwards are the listeners of a connection by the address or socket path the
+// client asked for. They are only used by the goroutine handling the requests.
+type forwards struct {
+	listeners map[string]net.Listener
+}
+
+func (f *forwards) add(addr string, l net.Listener) bool {
+	if _, ok := f.listeners[addr]; ok {
+		return false
+	}
+	f.listeners[addr] = l
+	return true
+}
+
+func (f *forwards) remove(addr string) bool {
+	l, ok := f.listeners[addr]
+	if ok {
+		l.Close()
+		delete(f.listeners, addr)
+	}
+	return ok
+}
+
+func (f *forwards) closeAll() {
+	for addr, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, addr)
+	}
+}
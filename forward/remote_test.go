@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/sshh"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// refused returns true once connections to the address are refused.
+func refused(addr string) bool {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRemoteForwarder(t *testing.T) {
+	forwarder := &RemoteForwarder{Policy: func(r *Request) error {
+		if r.Port != 0 {
+			return errors.New("only port 0 is allowed")
+		}
+		return nil
+	}}
+	dispatcher := &sshh.SimpleDispatcher{Logger: log.NullLog}
+	server := startServer(t, "127.0.0.1:9036", dispatcher, forwarder)
+	defer server.Stop()
+
+	client := dial(t, "127.0.0.1:9036")
+	defer client.Close()
+
+	// The allocated port is sent back to the client
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := l.Addr().String()
+	assert.NotEqual(t, "127.0.0.1:0", addr, "port should be allocated")
+
+	// Connections to the server are forwarded to the client
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if assert.Nil(t, err, "server should listen on the forwarded port") {
+		conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\n", line)
+		conn.Close()
+	}
+
+	// Cancelled forwards stop listening
+	l.Close()
+	assert.True(t, refused(addr), "listener should be closed when cancelled")
+
+	// Addresses denied by the policy are refused
+	_, err = client.Listen("tcp", "127.0.0.1:9037")
+	assert.NotNil(t, err, "forwarding should be denied")
+
+	// Listeners are closed when the connection ends
+	l, err = client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr = l.Addr().String()
+	client.Close()
+	assert.True(t, refused(addr), "listener should be closed with the connection")
+}
+
+func TestRemoteForwarderBind(t *testing.T) {
+	var listened []string
+	forwarder := &RemoteForwarder{Listen: func(network, address string) (net.Listener, error) {
+		listened = append(listened, address)
+		return net.Listen(network, "127.0.0.1:0")
+	}}
+	dispatcher := &sshh.SimpleDispatcher{Logger: log.NullLog}
+	server := startServer(t, "127.0.0.1:9042", dispatcher, forwarder)
+	defer server.Stop()
+
+	client := dial(t, "127.0.0.1:9042")
+	defer client.Close()
+
+	forward := func(host string) bool {
+		ok, _, err := client.SendRequest(TCPIPForward, true, ssh.Marshal(&Bind{Host: host}))
+		assert.Nil(t, err)
+		return ok
+	}
+
+	// Without GatewayPorts only loopback is listened on
+	for _, host := range []string{"", "*", "localhost", "127.0.0.1", "::1"} {
+		assert.True(t, forward(host), "%q should be allowed", host)
+	}
+	assert.Equal(t, []string{"127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0", "[::1]:0"}, listened)
+	assert.False(t, forward("0.0.0.0"), "other addresses should be refused")
+	assert.False(t, forward("192.0.2.1"), "other addresses should be refused")
+	assert.Equal(t, 5, len(listened))
+
+	// With GatewayPorts the requested address is listened on
+	listened = nil
+	forwarder.GatewayPorts = true
+	assert.True(t, forward("*"))
+	assert.True(t, forward("192.0.2.1"))
+	assert.Equal(t, []string{":0", "192.0.2.1:0"}, listened)
+}
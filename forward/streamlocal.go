@@ -0,0 +1,200 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blacklabeldata/sshh"
+	"golang.org/x/crypto/ssh"
+)
+
+// Unix domain socket forwarding channel and request types, as defined by
+// OpenSSH in PROTOCOL section 2.4.
+const (
+	DirectStreamLocal        = "direct-streamlocal@openssh.com"
+	StreamLocalForward       = "streamlocal-forward@openssh.com"
+	CancelStreamLocalForward = "cancel-streamlocal-forward@openssh.com"
+	ForwardedStreamLocal     = "forwarded-streamlocal@openssh.com"
+)
+
+// defaultSocketMode is the mode of the sockets created for remote forwarding
+// if none is set, the same as the OpenSSH StreamLocalBindMask.
+const defaultSocketMode os.FileMode = 0600
+
+type directStreamLocalMsg struct {
+	Path      string
+	Reserved0 string
+	Reserved1 uint32
+}
+
+type streamLocalForwardMsg struct {
+	Path string
+}
+
+type forwardedStreamLocalMsg struct {
+	Path     string
+	Reserved string
+}
+
+// ParseDirectStreamLocal parses the payload of a direct-streamlocal channel
+// and returns the socket path.
+func ParseDirectStreamLocal(payload []byte) (string, error) {
+	var msg directStreamLocalMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", ErrInvalidPayload
+	}
+	return msg.Path, nil
+}
+
+// ParseStreamLocalForward parses the payload of a streamlocal-forward or
+// cancel-streamlocal-forward request and returns the socket path.
+func ParseStreamLocalForward(payload []byte) (string, error) {
+	var msg streamLocalForwardMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", ErrInvalidPayload
+	}
+	return msg.Path, nil
+}
+
+// DirectStreamLocalHandler handles direct-streamlocal channels by connecting
+// to the Unix domain socket requested by the client, as used by ssh -L with a
+// socket path. Register it for the DirectStreamLocal channel type in a
+// SimpleDispatcher or in the Handlers of an UrlDispatcher.
+type DirectStreamLocalHandler struct {
+
+	// Paths lists the socket paths which may be opened, as path.Match
+	// patterns. If empty, no socket may be opened.
+	Paths []string
+
+	// Policy allows or denies the socket paths. If nil, Permissions is
+	// used.
+	Policy Policy
+
+	// Dial connects to the socket. If nil, net.Dialer is used with the
+	// Timeout.
+	Dial func(network, address string) (net.Conn, error)
+
+	// Timeout is the dial timeout. If zero, 10 seconds is used.
+	Timeout time.Duration
+}
+
+// ManualAccept returns true: the channel is accepted once the socket is
+// allowed and connected, see sshh.ManualAccept.
+func (h *DirectStreamLocalHandler) ManualAccept() bool {
+	return true
+}
+
+// Handle checks the socket path against the allowlist and the policy,
+// connects to it and copies the data both ways until both sides are closed.
+func (h *DirectStreamLocalHandler) Handle(ctx *sshh.Context) error {
+	path, err := ParseDirectStreamLocal(ctx.ExtraData())
+	if err != nil {
+		return ctx.Reject(ssh.ConnectionFailed, err.Error())
+	}
+	path, ok := cleanPath(path)
+	if !ok {
+		return ctx.Reject(ssh.Prohibited, ErrProhibited.Error())
+	}
+
+	req := &Request{Type: DirectStreamLocal, Path: path}
+	if ctx.Conn != nil {
+		req.User, req.Permissions = ctx.Conn.User(), ctx.Conn.Permissions
+	}
+	if !matchPath(h.Paths, path) {
+		return ctx.Reject(ssh.Prohibited, ErrProhibited.Error())
+	} else if err := check(h.Policy, req); err != nil {
+		return ctx.Reject(ssh.Prohibited, err.Error())
+	}
+
+	conn, err := h.dial("unix", path)
+	if err != nil {
+		return ctx.Reject(ssh.ConnectionFailed, err.Error())
+	}
+
+	channel, requests, err := ctx.Accept()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go ssh.DiscardRequests(requests)
+	pipe(ctx.Context, channel, conn)
+
+	// Forwarded connections have no exit status
+	ctx.Close()
+	return nil
+}
+
+func (h *DirectStreamLocalHandler) dial(network, address string) (net.Conn, error) {
+	if h.Dial != nil {
+		return h.Dial(network, address)
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// listenUnix listens on the socket path with the mode. If unlink is set, a
+// stale socket left at the path is removed first. The socket is removed when
+// the listener is closed.
+//
+// The socket is created in a private directory next to the path and linked to
+// the path once its mode is set, so it is never reachable with the mode given
+// by the umask.
+func listenUnix(path string, mode os.FileMode, unlink bool) (net.Listener, error) {
+	if unlink {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	if mode == 0 {
+		mode = defaultSocketMode
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".sshh")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Link(private, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener is a Unix domain socket listener which removes the socket at
+// the path when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Addr returns the socket path.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close stops listening and removes the socket.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if err == nil {
+		os.Remove(l.path)
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blacklabeldata/sshh"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDirectStreamLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Echo the data sent to the socket
+	socket := filepath.Join(dir, "echo.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	dispatcher := &sshh.SimpleDispatcher{
+		Logger: log.NullLog,
+		Handlers: map[string]sshh.Handler{
+			DirectStreamLocal: &DirectStreamLocalHandler{Paths: []string{filepath.Join(dir, "*.sock")}},
+		},
+	}
+	server := startServer(t, "127.0.0.1:9038", dispatcher, nil)
+	defer server.Stop()
+
+	client := dial(t, "127.0.0.1:9038")
+	defer client.Close()
+
+	// Allowed sockets are connected to
+	channel, requests, err := client.OpenChannel(DirectStreamLocal, ssh.Marshal(&directStreamLocalMsg{Path: socket}))
+	if assert.Nil(t, err, "socket should be allowed") {
+		go ssh.DiscardRequests(requests)
+		channel.Write([]byte("hello"))
+		channel.CloseWrite()
+		data, err := ioutil.ReadAll(channel)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+		channel.Close()
+	}
+
+	// Other paths are refused
+	_, _, err = client.OpenChannel(DirectStreamLocal, ssh.Marshal(&directStreamLocalMsg{Path: filepath.Join(dir, "other")}))
+	if assert.NotNil(t, err, "socket should be refused") {
+		assert.Contains(t, err.Error(), "administratively prohibited")
+	}
+	_, _, err = client.OpenChannel(DirectStreamLocal, ssh.Marshal(&directStreamLocalMsg{Path: "echo.sock"}))
+	assert.NotNil(t, err, "relative paths should be refused")
+
+	// The cleaned path is the one connected to
+	channel, requests, err = client.OpenChannel(DirectStreamLocal, ssh.Marshal(&directStreamLocalMsg{Path: dir + "/missing/../echo.sock"}))
+	if assert.Nil(t, err, "cleaned path should be connected to") {
+		go ssh.DiscardRequests(requests)
+		channel.Close()
+	}
+}
+
+func TestStreamLocalForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "remote.sock")
+
+	// Leave a stale socket behind
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	forwarder := &RemoteForwarder{
+		SocketPaths:  []string{filepath.Join(dir, "*.sock")},
+		SocketMode:   0660,
+		UnlinkSocket: true,
+	}
+	dispatcher := &sshh.SimpleDispatcher{Logger: log.NullLog}
+	server := startServer(t, "127.0.0.1:9039", dispatcher, forwarder)
+	defer server.Stop()
+
+	client := dial(t, "127.0.0.1:9039")
+	defer client.Close()
+
+	// Connections to the socket are forwarded to the client
+	channels := client.HandleChannelOpen(ForwardedStreamLocal)
+	ok, _, err := client.SendRequest(StreamLocalForward, true, ssh.Marshal(&streamLocalForwardMsg{socket}))
+	assert.Nil(t, err)
+	assert.True(t, ok, "socket should be allowed")
+	if info, err := os.Stat(socket); assert.Nil(t, err, "socket should be created") {
+		assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	}
+	if entries, err := ioutil.ReadDir(dir); assert.Nil(t, err) {
+		assert.Equal(t, 1, len(entries), "only the socket should be left in the directory")
+	}
+
+	go func() {
+		for ch := range channels {
+			var msg forwardedStreamLocalMsg
+			ssh.Unmarshal(ch.ExtraData(), &msg)
+			if msg.Path != socket {
+				ch.Reject(ssh.ConnectionFailed, "unknown socket")
+				continue
+			}
+			channel, requests, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(channel, channel)
+				channel.Close()
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("unix", socket)
+	if assert.Nil(t, err, "server should listen on the socket") {
+		conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\n", line)
+		conn.Close()
+	}
+
+	// Other paths are refused
+	ok, _, err = client.SendRequest(StreamLocalForward, true, ssh.Marshal(&streamLocalForwardMsg{filepath.Join(dir, "other")}))
+	assert.Nil(t, err)
+	assert.False(t, ok, "socket should be refused")
+
+	// The cleaned path is the one listened on
+	ok, _, err = client.SendRequest(StreamLocalForward, true, ssh.Marshal(&streamLocalForwardMsg{dir + "/missing/../cleaned.sock"}))
+	assert.Nil(t, err)
+	assert.True(t, ok, "cleaned path should be allowed")
+	_, err = os.Stat(filepath.Join(dir, "cleaned.sock"))
+	assert.Nil(t, err, "socket should be created at the cleaned path")
+
+	// The socket is removed when the forward is cancelled
+	ok, _, err = client.SendRequest(CancelStreamLocalForward, true, ssh.Marshal(&streamLocalForwardMsg{socket}))
+	assert.Nil(t, err)
+	assert.True(t, ok, "forward should be cancelled")
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err), "socket should be removed")
+}
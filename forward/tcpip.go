@@ -0,0 +1,153 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/sshh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// DirectTCPIP is the channel type of local port forwarding.
+const DirectTCPIP = "direct-tcpip"
+
+// ErrInvalidPayload is returned when a channel or request payload cannot be
+// parsed.
+var ErrInvalidPayload = errors.New("forward: invalid payload")
+
+// defaultDialTimeout is the dial timeout used if none is set.
+const defaultDialTimeout = 10 * time.Second
+
+// Target is the payload of a direct-tcpip channel, as defined in RFC 4254
+// section 7.2.
+type Target struct {
+	Host           string
+	Port           uint32
+	OriginatorHost string
+	OriginatorPort uint32
+}
+
+// ParseDirectTCPIP parses the payload of a direct-tcpip channel.
+func ParseDirectTCPIP(payload []byte) (Target, error) {
+	var t Target
+	if err := ssh.Unmarshal(payload, &t); err != nil {
+		return t, ErrInvalidPayload
+	}
+	return t, nil
+}
+
+// DirectTCPIPHandler handles direct-tcpip channels by connecting to the
+// destination requested by the client, as used by ssh -L. Register it for the
+// DirectTCPIP channel type in a SimpleDispatcher or in the Handlers of an
+// UrlDispatcher.
+type DirectTCPIPHandler struct {
+
+	// Policy allows or denies the destinations. If nil, Permissions is
+	// used.
+	Policy Policy
+
+	// Dial connects to the destination. If nil, net.Dialer is used with
+	// the Timeout.
+	Dial func(network, address string) (net.Conn, error)
+
+	// Timeout is the dial timeout. If zero, 10 seconds is used.
+	Timeout time.Duration
+}
+
+// ManualAccept returns true: the channel is accepted once the destination is
+// allowed and connected, see sshh.ManualAccept.
+func (h *DirectTCPIPHandler) ManualAccept() bool {
+	return true
+}
+
+// Handle checks the destination against the policy, connects to it and
+// copies the data both ways until both sides are closed.
+func (h *DirectTCPIPHandler) Handle(ctx *sshh.Context) error {
+	target, err := ParseDirectTCPIP(ctx.ExtraData())
+	if err != nil {
+		return ctx.Reject(ssh.ConnectionFailed, err.Error())
+	}
+
+	req := &Request{Type: DirectTCPIP, Host: target.Host, Port: int(target.Port)}
+	if ctx.Conn != nil {
+		req.User, req.Permissions = ctx.Conn.User(), ctx.Conn.Permissions
+	}
+	if err := check(h.Policy, req); err != nil {
+		return ctx.Reject(ssh.Prohibited, err.Error())
+	}
+
+	conn, err := h.dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		return ctx.Reject(ssh.ConnectionFailed, err.Error())
+	}
+
+	channel, requests, err := ctx.Accept()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go ssh.DiscardRequests(requests)
+	pipe(ctx.Context, channel, conn)
+
+	// Forwarded connections have no exit status
+	ctx.Close()
+	return nil
+}
+
+func (h *DirectTCPIPHandler) dial(network, address string) (net.Conn, error) {
+	if h.Dial != nil {
+		return h.Dial(network, address)
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// closeWriter is implemented by connections which can be half-closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data both ways between the channel and the connection. When one
+// side stops sending, the other side is half-closed. Both are closed once
+// neither sends, or when the server stops.
+func pipe(c context.Context, channel ssh.Channel, conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Done():
+			channel.Close()
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, channel)
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	wg.Wait()
+
+	conn.Close()
+	channel.Close()
+}
@@ -0,0 +1,130 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/blacklabeldata/sshh"
+	"github.com/blacklabeldata/sshh/router"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signer
+}
+
+// startServer starts an sshh server which accepts any password.
+func startServer(t *testing.T, bind string, dispatcher sshh.Dispatcher, consumer sshh.RequestConsumer) *sshh.SSHServer {
+	cfg := &sshh.Config{
+		Context:    context.Background(),
+		Dispatcher: dispatcher,
+		Consumer:   consumer,
+		Logger:     log.NullLog,
+		Bind:       bind,
+		PrivateKey: newSigner(t),
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	server, err := sshh.New(cfg)
+	if err != nil {
+		t.Fatal("error creating server", err.Error())
+	}
+	server.Start()
+	return &server
+}
+
+func dial(t *testing.T, addr string) *ssh.Client {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "jonny",
+		Auth: []ssh.AuthMethod{ssh.Password("bandit")},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return client
+}
+
+// echoServer echoes the data of each connection until the client half-closes
+// it.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDirectTCPIP(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	handler := &DirectTCPIPHandler{Policy: PermitOpen(echo.Addr().String())}
+	dispatchers := map[string]sshh.Dispatcher{
+		"127.0.0.1:9034": &sshh.SimpleDispatcher{
+			Logger:   log.NullLog,
+			Handlers: map[string]sshh.Handler{DirectTCPIP: handler},
+		},
+		"127.0.0.1:9035": &sshh.UrlDispatcher{
+			Logger:   log.NullLog,
+			Router:   router.New(log.NullLog, nil, nil),
+			Handlers: map[string]sshh.Handler{DirectTCPIP: handler},
+		},
+	}
+
+	for addr, dispatcher := range dispatchers {
+		server := startServer(t, addr, dispatcher, nil)
+		client := dial(t, addr)
+
+		// Data is copied both ways, with half-close
+		conn, err := client.Dial("tcp", echo.Addr().String())
+		if assert.Nil(t, err, "forwarding should be allowed") {
+			conn.Write([]byte("hello"))
+			conn.(interface {
+				CloseWrite() error
+			}).CloseWrite()
+			data, err := ioutil.ReadAll(conn)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(data))
+			conn.Close()
+		}
+
+		// Other destinations are denied by the policy
+		_, err = client.Dial("tcp", "127.0.0.1:1")
+		if assert.NotNil(t, err, "forwarding should be denied") {
+			assert.Contains(t, err.Error(), "administratively prohibited")
+		}
+
+		client.Close()
+		server.Stop()
+	}
+}
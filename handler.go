@@ -1,35 +1,114 @@
 package sshh
 
 import (
+	"github.com/blacklabeldata/sshh/router"
+
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 )
 
+// Handler handles a channel, accepted unless the handler accepts or rejects it
+// itself, see ManualAccept. Once it returns, if the channel was accepted the
+// result is sent to the client as the exit status and the channel is closed,
+// see ExitError. A channel which was neither accepted nor rejected is rejected
+// with ChannelHandleError.
 type Handler interface {
 	Handle(*Context) error
 }
 
 type HandlerFunc func(*Context) error
 
-type basicHandler struct {
-	hf HandlerFunc
+// Handle calls f, so functions can be given where a Handler is needed.
+func (f HandlerFunc) Handle(c *Context) error {
+	return f(c)
 }
 
-func (b *basicHandler) Handle(c *Context) error {
-	return b.hf(c)
+// Middleware wraps a Handler to run code around it, such as to check the
+// permissions of the user or log channels. AutoAccept is a Middleware.
+type Middleware func(Handler) Handler
+
+// chain wraps the handler with the middleware, the first one outermost.
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
 }
 
 type PanicHandler interface {
 	Handle(*Context, interface{})
 }
 
+var (
+	// ErrChannelAccepted is returned by Reject once the channel is accepted.
+	ErrChannelAccepted = router.ErrChannelAccepted
+
+	// ErrChannelRejected is returned by Accept and Reject once the channel
+	// is rejected.
+	ErrChannelRejected = router.ErrChannelRejected
+
+	// ErrChannelNotAccepted is returned by Close before the channel is
+	// accepted.
+	ErrChannelNotAccepted = router.ErrChannelNotAccepted
+)
+
+// Context is the channel handled by a Handler. The channel is accepted before
+// the handler is called, unless the handler accepts or rejects it itself, see
+// ManualAccept.
 type Context struct {
 	ChannelType string
 	Context     context.Context
-	Channel     ssh.Channel
-	Requests    <-chan *ssh.Request
+	Conn        *ssh.ServerConn
+	router.Acceptor
+}
+
+// ManualAccept returns a Handler which accepts or rejects its channels itself,
+// with the Accept and Reject methods of the Context. Handlers can also
+// implement router.ManualAcceptor.
+func ManualAccept(h Handler) Handler {
+	return &manualHandler{Handler: h}
+}
+
+type manualHandler struct {
+	Handler
+	router.Manual
+}
+
+// AutoAccept returns a Handler which accepts the channel before calling h. It
+// lets a manual handler accept the channel once its own checks passed, as in
+// ManualAccept(checkUser(AutoAccept(h))).
+func AutoAccept(h Handler) Handler {
+	return &acceptHandler{h}
+}
+
+// accepting returns a handler which accepts the channel before calling h,
+// unless h accepts or rejects its channels itself.
+func accepting(h Handler) Handler {
+	if router.IsManual(h) {
+		return h
+	}
+	return AutoAccept(h)
+}
+
+type acceptHandler struct {
+	handler Handler
+}
+
+func (h *acceptHandler) Handle(c *Context) error {
+	if err := c.AutoAccept(); err != nil {
+		return err
+	}
+	return h.handler.Handle(c)
 }
 
 type RequestConsumer interface {
 	Consume(<-chan *ssh.Request)
 }
+
+// ConnRequestConsumer is a RequestConsumer which needs the connection the
+// requests come from, such as to open channels back to the client. If the
+// Consumer implements it, ConsumeConn is called instead of Consume. The
+// context is done once the connection ends.
+type ConnRequestConsumer interface {
+	ConsumeConn(context.Context, *ssh.ServerConn, <-chan *ssh.Request)
+}
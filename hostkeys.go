@@ -0,0 +1,138 @@
+package sshh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/mgutz/logxi/v1"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrEd25519Unsupported is logged by LoadHostKeys for the Ed25519 host keys it
+// skips, which the vendored SSH package cannot use.
+var ErrEd25519Unsupported = errors.New("ssh server: Ed25519 host keys are not supported")
+
+// DefaultHostKeyTypes are the key types generated by LoadHostKeys if none are given.
+var DefaultHostKeyTypes = []string{"rsa", "ecdsa"}
+
+// hostKeyBits is the size of generated RSA host keys.
+const hostKeyBits = 3072
+
+// HostKeyFile returns the OpenSSH file name for a host key of the given type,
+// such as "ssh_host_rsa_key".
+func HostKeyFile(keyType string) string {
+	return "ssh_host_" + keyType + "_key"
+}
+
+// LoadHostKeys reads every OpenSSH host key named ssh_host_<type>_key in dir.
+// Keys for any of the given types which do not exist yet are generated and
+// written to dir, so the same keys are used on the next start. Keys can be
+// generated for the "rsa" and "ecdsa" types. If no types are given the
+// DefaultHostKeyTypes are used.
+//
+// Ed25519 host keys are not supported: the vendored golang.org/x/crypto/ssh
+// predates them, so they can neither be generated nor parsed. They are skipped
+// with a warning on log.DefaultLog, so a dir such as /etc/ssh can be loaded
+// with its other keys. See LoadHostKeysWithLogger to log elsewhere.
+func LoadHostKeys(dir string, types ...string) ([]ssh.Signer, error) {
+	return LoadHostKeysWithLogger(log.DefaultLog, dir, types...)
+}
+
+// LoadHostKeysWithLogger is LoadHostKeys, warning about the skipped Ed25519
+// host keys on the logger.
+func LoadHostKeysWithLogger(logger log.Logger, dir string, types ...string) ([]ssh.Signer, error) {
+	if len(types) == 0 {
+		types = DefaultHostKeyTypes
+	}
+
+	// Create the directory on first start
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Generate missing keys
+	for _, keyType := range types {
+		path := filepath.Join(dir, HostKeyFile(keyType))
+		if keyType == "ed25519" {
+			logger.Warn("Skipping host key", "type", keyType, "err", ErrEd25519Unsupported)
+			continue
+		} else if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		block, err := generateHostKey(keyType)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load all the keys
+	paths, err := filepath.Glob(filepath.Join(dir, HostKeyFile("*")))
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	for _, path := range paths {
+		if path == filepath.Join(dir, HostKeyFile("ed25519")) {
+			logger.Warn("Skipping host key", "path", path, "err", ErrEd25519Unsupported)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("ssh server: Invalid host key %s: %s", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// generateHostKey creates a new PEM encoded private key of the given type.
+func generateHostKey(keyType string) (*pem.Block, error) {
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, hostKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}, nil
+
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: der,
+		}, nil
+	}
+	return nil, fmt.Errorf("ssh server: Unsupported host key type %q", keyType)
+}
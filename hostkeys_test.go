@@ -0,0 +1,143 @@
+package sshh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blacklabeldata/sshh/router"
+	log "github.com/mgutz/logxi/v1"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func TestLoadHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	keyDir := filepath.Join(dir, "keys")
+
+	// Keys should be generated on first start
+	keys, err := LoadHostKeys(keyDir)
+	if !assert.Nil(t, err, "keys should be generated") {
+		return
+	}
+	assert.Equal(t, 2, len(keys), "an RSA and an ECDSA key should be generated")
+	for _, keyType := range DefaultHostKeyTypes {
+		info, err := os.Stat(filepath.Join(keyDir, HostKeyFile(keyType)))
+		if assert.Nil(t, err, "key file should exist") {
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "key file should be private")
+		}
+	}
+
+	// The same keys should be loaded on the next start
+	reloaded, err := LoadHostKeys(keyDir)
+	if !assert.Nil(t, err, "keys should be loaded") {
+		return
+	}
+	assert.Equal(t, len(keys), len(reloaded))
+	for i := range keys {
+		assert.True(t, bytes.Equal(keys[i].PublicKey().Marshal(), reloaded[i].PublicKey().Marshal()), "keys should not be regenerated")
+	}
+
+	// Existing keys are loaded even if their type is not requested
+	err = ioutil.WriteFile(filepath.Join(keyDir, HostKeyFile("legacy")), []byte(serverKey), 0600)
+	assert.Nil(t, err)
+	keys, err = LoadHostKeys(keyDir, "ecdsa")
+	assert.Nil(t, err, "keys should be loaded")
+	assert.Equal(t, 3, len(keys), "all host key files should be loaded")
+
+	// Ed25519 keys are skipped, as they cannot be generated nor loaded
+	keys, err = LoadHostKeysWithLogger(log.NullLog, keyDir, "rsa", "ed25519")
+	assert.Nil(t, err, "ed25519 keys should not be generated")
+	assert.Equal(t, 3, len(keys), "the other keys should be loaded")
+	_, err = os.Stat(filepath.Join(keyDir, HostKeyFile("ed25519")))
+	assert.True(t, os.IsNotExist(err), "ed25519 key should not be written")
+
+	err = ioutil.WriteFile(filepath.Join(keyDir, HostKeyFile("ed25519")), []byte("openssh key"), 0600)
+	assert.Nil(t, err)
+	keys, err = LoadHostKeysWithLogger(log.NullLog, keyDir)
+	assert.Nil(t, err, "ed25519 keys should be skipped")
+	assert.Equal(t, 3, len(keys), "the other keys should be loaded")
+
+	// Invalid keys should return an error
+	err = ioutil.WriteFile(filepath.Join(keyDir, HostKeyFile("bad")), []byte("not a key"), 0600)
+	assert.Nil(t, err)
+	_, err = LoadHostKeys(keyDir)
+	assert.NotNil(t, err, "invalid key files should return an error")
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	keys, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		algorithms []string
+		expected   string
+	}{
+		{nil, ssh.KeyAlgoECDSA256},
+		{[]string{ssh.KeyAlgoRSA}, ssh.KeyAlgoRSA},
+		{[]string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA}, ssh.KeyAlgoECDSA256},
+	}
+
+	for _, test := range tests {
+		r := router.New(log.NullLog, nil, nil)
+		cfg := &Config{
+			Context:           context.Background(),
+			Dispatcher:        &UrlDispatcher{Router: r, Logger: log.NullLog},
+			Logger:            log.NullLog,
+			Bind:              "127.0.0.1:9026",
+			HostKeys:          keys,
+			HostKeyAlgorithms: test.algorithms,
+			PasswordCallback:  passwordCallback,
+		}
+
+		server, err := New(cfg)
+		if err != nil {
+			t.Fatal("error creating server", err.Error())
+		}
+		server.Start()
+
+		// Record the host key the client was offered
+		var keyType string
+		client, err := ssh.Dial("tcp", "127.0.0.1:9026", &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password("bandit"),
+			},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				keyType = key.Type()
+				return nil
+			},
+		})
+		if assert.Nil(t, err, "client should connect") {
+			client.Close()
+		}
+		assert.Equal(t, test.expected, keyType)
+		server.Stop()
+	}
+
+	// Filtering out every key should fail
+	_, err = New(&Config{
+		Context:           context.Background(),
+		Bind:              "127.0.0.1:9026",
+		HostKeys:          keys,
+		HostKeyAlgorithms: []string{ssh.KeyAlgoDSA},
+	})
+	assert.NotNil(t, err, "server without host keys should not be created")
+}
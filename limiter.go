@@ -0,0 +1,334 @@
+package sshh
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blacklabeldata/sshh/auth"
+	log "github.com/mgutz/logxi/v1"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrBanned is returned to authentication attempts from banned addresses or for
+// banned users.
+var ErrBanned = errors.New("ssh: too many authentication failures")
+
+// Ban is a source address or user name which is locked out.
+type Ban struct {
+
+	// IP is set for address bans.
+	IP string
+
+	// User is set for user name bans.
+	User string
+
+	// Until is when the ban expires.
+	Until time.Time
+}
+
+// AuthLimiter protects against brute-force attacks by banning source addresses
+// and user names after too many failed authentication attempts within a
+// sliding window. It watches the outcome of every attempt through the
+// AuthLogCallback, so it works with any authentication callbacks. A successful
+// login clears the failures of the address and the user.
+//
+// Connections from banned addresses are closed before the handshake. If a
+// Tarpit is set they are slowed down instead: every authentication attempt is
+// delayed and refused. Banned users are refused by every method.
+//
+// The same AuthLimiter can be kept across Reload so bans are not lost.
+type AuthLimiter struct {
+
+	// MaxFailures is the number of failures within the Window which
+	// causes a ban. If zero, 10 is used. Each public key offered by a
+	// client which is not accepted counts as a failure.
+	MaxFailures int
+
+	// Window is the sliding window in which failures are counted. If
+	// zero, one minute is used.
+	Window time.Duration
+
+	// BanDuration is how long a ban lasts. If zero, 10 minutes is used.
+	BanDuration time.Duration
+
+	// Tarpit, if non-zero, delays authentication attempts from banned
+	// addresses instead of closing their connections.
+	Tarpit time.Duration
+
+	// Allowlist lists the addresses and CIDR ranges which are never
+	// banned. Invalid entries are ignored.
+	Allowlist []string
+
+	// Logger logs ban events. If nil, nothing is logged.
+	Logger log.Logger
+
+	// Clock returns the current time. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu       sync.Mutex
+	allowed  []*net.IPNet
+	parsed   bool
+	failures map[Ban][]time.Time
+	bans     map[Ban]time.Time
+}
+
+// Banned returns true if the address or the user is banned. Addresses in the
+// Allowlist are never banned.
+func (l *AuthLimiter) Banned(addr net.Addr, user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, now := hostIP(addr), l.now()
+	if l.allowedIP(ip) {
+		return false
+	}
+	return l.banned(Ban{IP: ip}, now) || (user != "" && l.banned(Ban{User: user}, now))
+}
+
+// Bans returns the current bans, the soonest to expire first.
+func (l *AuthLimiter) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	var bans []Ban
+	for key, until := range l.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{IP: key.IP, User: key.User, Until: until})
+		}
+	}
+	sort.Sort(bansByExpiry(bans))
+	return bans
+}
+
+// UnbanIP lifts the ban on an address and clears its failures. It returns false
+// if the address was not banned.
+func (l *AuthLimiter) UnbanIP(ip string) bool {
+	return l.unban(Ban{IP: ip})
+}
+
+// UnbanUser lifts the ban on a user and clears their failures. It returns false
+// if the user was not banned.
+func (l *AuthLimiter) UnbanUser(user string) bool {
+	return l.unban(Ban{User: user})
+}
+
+func (l *AuthLimiter) unban(key Ban) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.bans[key]
+	delete(l.bans, key)
+	delete(l.failures, key)
+	if ok {
+		l.logger().Info("Ban lifted", "ip", key.IP, "user", key.User)
+	}
+	return ok
+}
+
+// record counts the outcome of an authentication attempt.
+func (l *AuthLimiter) record(conn ssh.ConnMetadata, method string, err error) {
+
+	// Clients always try none first to find out the methods, and methods
+	// which partially succeeded are not failures
+	if method == "none" || err == ErrBanned || err == auth.ErrPartialAuth {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := []Ban{{IP: hostIP(conn.RemoteAddr())}, {User: conn.User()}}
+	if err == nil {
+		for _, key := range keys {
+			delete(l.failures, key)
+		}
+		return
+	}
+
+	now := l.now()
+	if l.allowedIP(keys[0].IP) {
+		return
+	}
+	for _, key := range keys {
+		if l.banned(key, now) {
+			continue
+		}
+
+		// Drop the failures outside the window
+		failures := l.failures[key]
+		for len(failures) > 0 && !failures[0].After(now.Add(-l.window())) {
+			failures = failures[1:]
+		}
+		failures = append(failures, now)
+
+		if len(failures) < l.maxFailures() {
+			if l.failures == nil {
+				l.failures = make(map[Ban][]time.Time)
+			}
+			l.failures[key] = failures
+			continue
+		}
+
+		delete(l.failures, key)
+		if l.bans == nil {
+			l.bans = make(map[Ban]time.Time)
+		}
+		l.bans[key] = now.Add(l.banDuration())
+		l.logger().Warn("Too many authentication failures, banned", "ip", key.IP, "user", key.User,
+			"failures", len(failures), "until", l.bans[key])
+	}
+}
+
+// wrap changes the callbacks of the SSH config to refuse banned addresses and
+// users, and to record the outcome of each attempt.
+func (l *AuthLimiter) wrap(config *ssh.ServerConfig) {
+	logCallback := config.AuthLogCallback
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		l.record(conn, method, err)
+		if logCallback != nil {
+			logCallback(conn, method, err)
+		}
+	}
+
+	if cb := config.PasswordCallback; cb != nil {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if l.refuse(conn) {
+				return nil, ErrBanned
+			}
+			return cb(conn, password)
+		}
+	}
+	if cb := config.PublicKeyCallback; cb != nil {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if l.refuse(conn) {
+				return nil, ErrBanned
+			}
+			return cb(conn, key)
+		}
+	}
+	if cb := config.KeyboardInteractiveCallback; cb != nil {
+		config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if l.refuse(conn) {
+				return nil, ErrBanned
+			}
+			return cb(conn, client)
+		}
+	}
+}
+
+// refuse returns true if the attempt must be refused, after the tarpit delay.
+func (l *AuthLimiter) refuse(conn ssh.ConnMetadata) bool {
+	if !l.Banned(conn.RemoteAddr(), conn.User()) {
+		return false
+	}
+	if l.Tarpit > 0 {
+		time.Sleep(l.Tarpit)
+	}
+	return true
+}
+
+// reject returns true if a new connection from the address should be closed
+// before the handshake.
+func (l *AuthLimiter) reject(addr net.Addr) bool {
+	return l.Tarpit <= 0 && l.Banned(addr, "")
+}
+
+// banned returns true if the key is banned, removing expired bans.
+func (l *AuthLimiter) banned(key Ban, now time.Time) bool {
+	until, ok := l.bans[key]
+	if ok && !now.Before(until) {
+		delete(l.bans, key)
+		return false
+	}
+	return ok
+}
+
+// allowedIP returns true if the address is in the Allowlist.
+func (l *AuthLimiter) allowedIP(ip string) bool {
+	if !l.parsed {
+		for _, entry := range l.Allowlist {
+			if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+				l.allowed = append(l.allowed, ipnet)
+			} else if addr := net.ParseIP(entry); addr != nil {
+				bits := 8 * len(addr.To16())
+				if addr.To4() != nil {
+					addr, bits = addr.To4(), 32
+				}
+				l.allowed = append(l.allowed, &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)})
+			}
+		}
+		l.parsed = true
+	}
+
+	addr := net.ParseIP(ip)
+	for _, ipnet := range l.allowed {
+		if addr != nil && ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AuthLimiter) now() time.Time {
+	if l.Clock == nil {
+		return time.Now()
+	}
+	return l.Clock()
+}
+
+func (l *AuthLimiter) logger() log.Logger {
+	if l.Logger == nil {
+		return log.NullLog
+	}
+	return l.Logger
+}
+
+func (l *AuthLimiter) maxFailures() int {
+	if l.MaxFailures <= 0 {
+		return 10
+	}
+	return l.MaxFailures
+}
+
+func (l *AuthLimiter) window() time.Duration {
+	if l.Window <= 0 {
+		return time.Minute
+	}
+	return l.Window
+}
+
+func (l *AuthLimiter) banDuration() time.Duration {
+	if l.BanDuration <= 0 {
+		return 10 * time.Minute
+	}
+	return l.BanDuration
+}
+
+// hostIP returns the IP address of a TCP address, or the whole address for
+// other networks.
+func hostIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+type bansByExpiry []Ban
+
+func (b bansByExpiry) Len() int      { return len(b) }
+func (b bansByExpiry) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// Less orders bans by expiry, then address bans before user bans.
+func (b bansByExpiry) Less(i, j int) bool {
+	switch {
+	case !b[i].Until.Equal(b[j].Until):
+		return b[i].Until.Before(b[j].Until)
+	case b[i].IP != b[j].IP:
+		return b[j].IP == "" || (b[i].IP != "" && b[i].IP < b[j].IP)
+	}
+	return b[i].User < b[j].User
+}
@@ -0,0 +1,183 @@
+package sshh
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/sshh/auth"
+	log "github.com/mgutz/logxi/v1"
+
+	sshmocks "github.com/blacklabeldata/mockery/ssh"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+var errAuth = errors.New("ssh: no auth passed yet")
+
+func connMetadata(user, addr string) *sshmocks.MockConnMetadata {
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	conn := &sshmocks.MockConnMetadata{UserName: user, Remote: remote}
+	conn.On("User").Return(user)
+	conn.On("RemoteAddr").Return(remote)
+	return conn
+}
+
+func TestAuthLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := &AuthLimiter{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanDuration: 10 * time.Minute,
+		Allowlist:   []string{"10.0.0.0/8", "192.168.1.1"},
+		Logger:      log.NullLog,
+		Clock:       func() time.Time { return now },
+	}
+	fail := func(user, addr string) {
+		limiter.record(connMetadata(user, addr), "password", errAuth)
+	}
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+
+	// The none method does not count
+	for i := 0; i < 5; i++ {
+		limiter.record(connMetadata("jonny", "1.2.3.4:1000"), "none", errAuth)
+	}
+	assert.False(t, limiter.Banned(addr("1.2.3.4:1000"), "jonny"))
+
+	// Failures outside the window expire
+	fail("jonny", "1.2.3.4:1000")
+	fail("hadji", "1.2.3.4:1001")
+	now = now.Add(2 * time.Minute)
+	fail("race", "1.2.3.4:1002")
+	assert.False(t, limiter.Banned(addr("1.2.3.4:1000"), ""), "old failures should have expired")
+
+	// Three failures within the window ban the address
+	fail("bandit", "1.2.3.4:1003")
+	fail("dr.zin", "1.2.3.4:1004")
+	assert.True(t, limiter.Banned(addr("1.2.3.4:5000"), ""), "address should be banned")
+	assert.False(t, limiter.Banned(addr("5.6.7.8:5000"), "jonny"), "other addresses should not be banned")
+
+	// Users are banned across addresses
+	fail("jonny", "5.6.7.8:1000")
+	fail("jonny", "5.6.7.9:1000")
+	fail("jonny", "5.6.7.10:1000")
+	assert.True(t, limiter.Banned(addr("8.8.8.8:1000"), "jonny"), "user should be banned")
+
+	bans := limiter.Bans()
+	if assert.Len(t, bans, 2) {
+		assert.Equal(t, "1.2.3.4", bans[0].IP)
+		assert.Equal(t, now.Add(10*time.Minute), bans[0].Until)
+	}
+
+	// Successful logins clear the failures
+	fail("hadji", "5.6.7.11:1000")
+	fail("hadji", "5.6.7.12:1000")
+	limiter.record(connMetadata("hadji", "5.6.7.13:1000"), "password", nil)
+	fail("hadji", "5.6.7.14:1000")
+	assert.False(t, limiter.Banned(addr("8.8.8.8:1000"), "hadji"), "failures should be cleared by a login")
+
+	// Allowlisted addresses are never banned
+	for i := 0; i < 5; i++ {
+		fail("race", "10.1.2.3:1000")
+		fail("race", "192.168.1.1:1000")
+	}
+	assert.False(t, limiter.Banned(addr("10.1.2.3:1000"), ""))
+	assert.False(t, limiter.Banned(addr("192.168.1.1:1000"), ""))
+
+	// Bans can be lifted
+	assert.True(t, limiter.UnbanIP("1.2.3.4"))
+	assert.False(t, limiter.UnbanIP("1.2.3.4"), "address should no longer be banned")
+	assert.False(t, limiter.Banned(addr("1.2.3.4:5000"), ""))
+	assert.True(t, limiter.UnbanUser("jonny"))
+	assert.False(t, limiter.Banned(addr("8.8.8.8:1000"), "jonny"))
+
+	// Bans expire
+	now = now.Add(11 * time.Minute)
+	assert.Empty(t, limiter.Bans(), "bans should have expired")
+}
+
+func TestAuthLimiterServer(t *testing.T) {
+
+	var logged int32
+	limiter := &AuthLimiter{MaxFailures: 2, Logger: log.NullLog}
+	server := startServer(t, "127.0.0.1:9028", func(cfg *Config) {
+		cfg.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+			atomic.AddInt32(&logged, 1)
+		}
+		cfg.AuthLimiter = limiter
+	})
+	defer server.Stop()
+
+	dial := func(password string) error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:9028", &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password(password),
+			},
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	assert.NotNil(t, dial("wrong"))
+	assert.NotNil(t, dial("wrong"))
+	assert.True(t, atomic.LoadInt32(&logged) > 0, "AuthLogCallback should still be called")
+
+	// The address is banned so even the right password is refused
+	assert.NotNil(t, dial("bandit"), "banned address should be refused")
+	assert.Len(t, limiter.Bans(), 2, "address and user should be banned")
+
+	limiter.UnbanIP("127.0.0.1")
+	limiter.UnbanUser("jonny.quest")
+	assert.Nil(t, dial("bandit"), "address should be allowed once unbanned")
+}
+
+func TestAuthLimiterMultiFactor(t *testing.T) {
+	limiter := &AuthLimiter{MaxFailures: 2, Logger: log.NullLog}
+	server := startServer(t, "127.0.0.1:9041", func(cfg *Config) {
+		mf := &auth.MultiFactor{
+			Default:  []auth.Chain{{auth.MethodPassword, auth.MethodKeyboardInteractive}},
+			Password: cfg.PasswordCallback,
+			KeyboardInteractive: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client(conn.User(), "", []string{"Code: "}, []bool{true})
+				if err != nil || len(answers) != 1 || answers[0] != "42" {
+					return nil, errors.New("wrong code")
+				}
+				return &ssh.Permissions{}, nil
+			},
+		}
+		cfg.PasswordCallback = mf.PasswordCallback
+		cfg.KeyboardInteractiveCallback = mf.KeyboardInteractiveCallback
+		cfg.AuthLimiter = limiter
+	})
+	defer server.Stop()
+
+	dial := func(code string) error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:9041", &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password("bandit"),
+				ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					return []string{code}, nil
+				}),
+			},
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	// The password only partially succeeds, which is not a failure, so a
+	// single wrong code stays below the limit
+	assert.NotNil(t, dial("0"), "wrong code should be refused")
+	assert.Empty(t, limiter.Bans(), "partial authentication should not count as a failure")
+	assert.Nil(t, dial("42"), "chain should be completed")
+}
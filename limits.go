@@ -0,0 +1,39 @@
+package sshh
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// refuseTimeout is how long a refused connection is kept open to deliver the
+// reason.
+const refuseTimeout = 10 * time.Second
+
+// refuseConn refuses a connection before the handshake: it writes the reason
+// as a line, waiting at most a second for the client to read it, then closes
+// the connection. RFC 4253 allows lines before the version string.
+func refuseConn(conn net.Conn, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "%s\r\n", reason)
+	conn.Close()
+}
+
+// refuseChannels rejects the first channel opened on an authenticated
+// connection which is refused, so that the client can show the reason. The
+// SSH package has no way to send a disconnect message.
+func refuseChannels(c context.Context, channels <-chan ssh.NewChannel, requests <-chan *ssh.Request, reason string) {
+	go ssh.DiscardRequests(requests)
+
+	select {
+	case ch, ok := <-channels:
+		if ok {
+			ch.Reject(ssh.ResourceShortage, reason)
+		}
+	case <-time.After(refuseTimeout):
+	case <-c.Done():
+	}
+}
@@ -0,0 +1,147 @@
+package sshh
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnTrackerLimits(t *testing.T) {
+	conns := newConnTracker()
+	limits := connLimits{total: 3, perIP: 2, startups: 2}
+
+	admit := func(ip string) string {
+		return conns.admit(ip, limits)
+	}
+
+	assert.Equal(t, "", admit("1.1.1.1"))
+	assert.Equal(t, "", admit("1.1.1.1"))
+	assert.Equal(t, "too many unauthenticated connections", admit("2.2.2.2"))
+
+	// Authenticated connections no longer count as startups
+	conns.handshakeDone()
+	conns.handshakeDone()
+	assert.Equal(t, "too many connections from 1.1.1.1", admit("1.1.1.1"))
+	assert.Equal(t, "", admit("2.2.2.2"))
+	assert.Equal(t, "too many connections", admit("3.3.3.3"))
+
+	// Users are limited separately
+	assert.True(t, conns.addUser("jonny", 1))
+	assert.False(t, conns.addUser("jonny", 1))
+	assert.True(t, conns.addUser("hadji", 0), "zero should mean no limit")
+
+	stats := conns.stats()
+	assert.Equal(t, uint64(4), stats.RefusedConnections)
+	assert.Equal(t, 1, stats.Handshakes)
+	assert.Equal(t, map[string]int{"1.1.1.1": 2, "2.2.2.2": 1}, stats.ConnectionsByIP)
+	assert.Equal(t, map[string]int{"jonny": 1, "hadji": 1}, stats.SessionsByUser)
+
+	conns.release("1.1.1.1")
+	conns.release("1.1.1.1")
+	conns.removeUser("jonny")
+	stats = conns.stats()
+	assert.Equal(t, map[string]int{"2.2.2.2": 1}, stats.ConnectionsByIP)
+	assert.Equal(t, map[string]int{"hadji": 1}, stats.SessionsByUser)
+}
+
+func TestConnTrackerConcurrentAdmit(t *testing.T) {
+	conns := newConnTracker()
+	limits := connLimits{total: 5}
+
+	// Connections are added by the listener before they are admitted, which
+	// must not count against the limit
+	for i := 0; i < 10; i++ {
+		conns.add()
+	}
+	assert.Equal(t, "", conns.admit("1.1.1.1", limits), "pending connections should not be counted")
+	conns.release("1.1.1.1")
+	for i := 0; i < 10; i++ {
+		conns.done()
+	}
+
+	var admitted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		conns.add()
+		go func() {
+			defer wg.Done()
+			if conns.admit("1.1.1.1", limits) == "" {
+				atomic.AddInt32(&admitted, 1)
+			} else {
+				conns.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(5), admitted, "exactly the limit should be admitted")
+	assert.Equal(t, uint64(45), conns.stats().RefusedConnections)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	server := startServer(t, "127.0.0.1:9029", func(cfg *Config) {
+		cfg.MaxConnectionsPerIP = 2
+		cfg.MaxSessionsPerUser = 1
+	})
+	defer server.Stop()
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", "127.0.0.1:9029", &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password("bandit"),
+			},
+		})
+	}
+
+	client, err := dial()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	// The second session for the user is refused
+	second, err := dial()
+	if assert.Nil(t, err, "handshake should succeed") {
+		_, _, err = second.OpenChannel("/echo", nil)
+		if assert.NotNil(t, err, "channel should be rejected") {
+			assert.Contains(t, err.Error(), "too many sessions for jonny.quest")
+		}
+		second.Close()
+	}
+
+	// Wait for the refused session to be released
+	for i := 0; i < 100 && server.Stats().ConnectionsByIP["127.0.0.1"] > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := server.Stats()
+	assert.Equal(t, map[string]int{"jonny.quest": 1}, stats.SessionsByUser)
+	assert.Equal(t, map[string]int{"127.0.0.1": 1}, stats.ConnectionsByIP)
+
+	// Connections from the same address are refused with a message
+	pending, err := net.Dial("tcp", "127.0.0.1:9029")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pending.Close()
+	for i := 0; i < 100 && server.Stats().Handshakes == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	refused, err := net.Dial("tcp", "127.0.0.1:9029")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer refused.Close()
+	line, err := bufio.NewReader(refused).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "too many connections from 127.0.0.1\r\n", line)
+	assert.Equal(t, uint64(2), server.Stats().RefusedConnections)
+}
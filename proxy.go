@@ -0,0 +1,209 @@
+package sshh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the maximum time a client has to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1Prefix starts every PROXY protocol v1 header.
+var proxyV1Prefix = []byte("PROXY ")
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// ErrInvalidProxyHeader is returned when a PROXY protocol header cannot be parsed.
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ErrMissingProxyHeader is returned when a trusted proxy did not send a PROXY
+// protocol header.
+var ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyConn is a net.Conn which reports the client address sent in a PROXY
+// protocol header rather than the address of the load balancer.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// Read reads from the buffered reader so no bytes after the header are lost.
+func (p *proxyConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, if any.
+func (p *proxyConn) RemoteAddr() net.Addr {
+	if p.remoteAddr != nil {
+		return p.remoteAddr
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// parseTrustedProxies parses a list of CIDR ranges.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ssh server: Invalid trusted proxy %q", cidr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns true if PROXY headers are accepted from the given address.
+// If no ranges are given no source is trusted.
+func trustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header of a connection
+// from a trusted proxy. The returned connection reports the client address
+// from the header, or its original address for UNKNOWN and LOCAL headers. It
+// fails with ErrMissingProxyHeader if the proxy did not send a header.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		addr, err = parseProxyV1(reader)
+	case proxyV2Signature[0]:
+		addr, err = parseProxyV2(reader)
+	default:
+		err = ErrMissingProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{conn, reader, addr}, nil
+}
+
+// parseProxyV1 parses a human readable PROXY protocol v1 header. A nil address
+// is returned for UNKNOWN connections.
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil || !bytes.Equal(prefix, proxyV1Prefix) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// The header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, ErrInvalidProxyHeader
+		}
+	case "TCP6":
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	if _, err = strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses a binary PROXY protocol v2 header. A nil address is
+// returned for LOCAL connections and unsupported address families.
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	// Read the address block
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0F {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,159 @@
+package sshh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+func proxyV2Header(cmd, fam byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestParseProxyV1(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		valid  bool
+	}{
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 22\r\n", "192.168.0.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4000 22\r\n", "[2001:db8::1]:4000", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 10.0.0.1 56324 22\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 99999 22\r\n", "", false},
+		{"PROXY UDP4 192.168.0.1 10.0.0.1 56324 22\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 22\n", "", false},
+	}
+
+	for _, test := range tests {
+		addr, err := parseProxyV1(bufio.NewReader(bytes.NewBufferString(test.header)))
+		if !test.valid {
+			assert.NotNil(t, err, "header should be invalid: "+test.header)
+			continue
+		}
+		if assert.Nil(t, err, "header should be valid: "+test.header) {
+			if test.addr == "" {
+				assert.Nil(t, addr, "address should be unknown")
+			} else {
+				assert.Equal(t, test.addr, addr.String())
+			}
+		}
+	}
+}
+
+func TestParseProxyV2(t *testing.T) {
+	ipv4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0, 22}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 4000)
+	binary.BigEndian.PutUint16(ipv6[34:], 22)
+
+	tests := []struct {
+		header []byte
+		addr   string
+		valid  bool
+	}{
+		{proxyV2Header(0x1, 0x11, ipv4), "192.168.0.1:56324", true},
+		{proxyV2Header(0x1, 0x21, ipv6), "[2001:db8::1]:4000", true},
+		{proxyV2Header(0x0, 0x00, nil), "", true},
+		{proxyV2Header(0x1, 0x11, ipv4[:4]), "", false},
+		{proxyV2Header(0x2, 0x11, ipv4), "", false},
+		{append([]byte{0x0D, 0x0A, 0x0D}, make([]byte, 13)...), "", false},
+	}
+
+	for _, test := range tests {
+		addr, err := parseProxyV2(bufio.NewReader(bytes.NewBuffer(test.header)))
+		if !test.valid {
+			assert.NotNil(t, err, "header should be invalid")
+			continue
+		}
+		if assert.Nil(t, err, "header should be valid") {
+			if test.addr == "" {
+				assert.Nil(t, addr, "address should be unknown")
+			} else {
+				assert.Equal(t, test.addr, addr.String())
+			}
+		}
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	assert.Nil(t, err, "CIDRs should be valid")
+
+	assert.True(t, trustedProxy(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, trusted))
+	assert.True(t, trustedProxy(&net.TCPAddr{IP: net.ParseIP("2001:db8::5")}, trusted))
+	assert.False(t, trustedProxy(&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, trusted))
+	assert.False(t, trustedProxy(&net.UnixAddr{Name: "/tmp/sshh.sock"}, trusted))
+	assert.False(t, trustedProxy(&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, nil), "no source should be trusted by default")
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0"})
+	assert.NotNil(t, err, "CIDR without a mask should be invalid")
+}
+
+func TestProxyProtocol(t *testing.T) {
+
+	// Record the address seen by the auth callback
+	addrs := make(chan string, 1)
+	server := startServer(t, "127.0.0.1:9025", func(cfg *Config) {
+		cfg.ProxyProtocol = true
+		cfg.TrustedProxies = []string{"127.0.0.0/8"}
+		cfg.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			addrs <- conn.RemoteAddr().String()
+			return passwordCallback(conn, password)
+		}
+	})
+	defer server.Stop()
+
+	// Send the PROXY header before the SSH handshake
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:9025", time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 9025\r\n"))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "127.0.0.1:9025", &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	assert.Equal(t, "203.0.113.7:40000", <-addrs, "auth callback should see the client address")
+
+	// Trusted proxies must send a header
+	_, err = ssh.Dial("tcp", "127.0.0.1:9025", &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	})
+	assert.NotNil(t, err, "connection without a PROXY header should be refused")
+}
+
+func TestProxyProtocolWithoutTrustedProxies(t *testing.T) {
+	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+	if err != nil {
+		t.Fatal("Private key could not be parsed", err.Error())
+	}
+
+	_, err = New(&Config{Context: context.Background(), Bind: "127.0.0.1:9040", PrivateKey: signer, ProxyProtocol: true})
+	assert.NotNil(t, err, "PROXY headers should not be trusted from every source")
+}
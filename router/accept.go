@@ -0,0 +1,168 @@
+package router
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrChannelAccepted is returned by Reject once the channel is accepted.
+	ErrChannelAccepted = errors.New("channel already accepted")
+
+	// ErrChannelRejected is returned by Accept and Reject once the channel
+	// is rejected.
+	ErrChannelRejected = errors.New("channel already rejected")
+
+	// ErrChannelNotAccepted is returned by Close before the channel is
+	// accepted.
+	ErrChannelNotAccepted = errors.New("channel not accepted")
+)
+
+// AcceptError is returned when a channel could not be accepted on behalf of
+// its handler.
+type AcceptError struct {
+	Err error
+}
+
+func (e *AcceptError) Error() string {
+	return "error accepting channel: " + e.Err.Error()
+}
+
+// Acceptor holds a new channel until it is accepted or rejected. It is embedded
+// in the contexts given to handlers. Channel and Requests are set once the
+// channel is accepted.
+type Acceptor struct {
+	NewChannel ssh.NewChannel
+	Channel    ssh.Channel
+	Requests   <-chan *ssh.Request
+
+	rejected bool
+	closed   bool
+}
+
+// Accept accepts the channel, setting Channel and Requests. It does nothing if
+// the channel is already accepted.
+func (a *Acceptor) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	if a.Channel != nil {
+		return a.Channel, a.Requests, nil
+	} else if a.rejected {
+		return nil, nil, ErrChannelRejected
+	}
+
+	channel, requests, err := a.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	a.Channel, a.Requests = channel, requests
+	return channel, requests, nil
+}
+
+// Reject rejects the channel. It fails once the channel is accepted.
+func (a *Acceptor) Reject(reason ssh.RejectionReason, message string) error {
+	if a.Channel != nil {
+		return ErrChannelAccepted
+	} else if a.rejected {
+		return ErrChannelRejected
+	}
+	a.rejected = true
+	return a.NewChannel.Reject(reason, message)
+}
+
+// Rejected returns true if the channel was rejected.
+func (a *Acceptor) Rejected() bool {
+	return a.rejected
+}
+
+// Close closes the accepted channel. Handlers which are done with a channel
+// that is not a session, such as a forwarded connection, close it so no exit
+// status is sent on it.
+func (a *Acceptor) Close() error {
+	if a.Channel == nil {
+		return ErrChannelNotAccepted
+	}
+	a.closed = true
+	return a.Channel.Close()
+}
+
+// Closed returns true if the handler closed the channel.
+func (a *Acceptor) Closed() bool {
+	return a.closed
+}
+
+// ExtraData returns the payload sent by the client to open the channel, such
+// as to decide whether to accept it.
+func (a *Acceptor) ExtraData() []byte {
+	return a.NewChannel.ExtraData()
+}
+
+// AutoAccept accepts the channel on behalf of a handler which does not accept
+// it itself, returning an AcceptError if it fails. Contexts without a
+// NewChannel, such as ones given an accepted Channel, are left as they are.
+func (a *Acceptor) AutoAccept() error {
+	if a.NewChannel == nil {
+		return nil
+	}
+	if _, _, err := a.Accept(); err != nil {
+		return &AcceptError{err}
+	}
+	return nil
+}
+
+// ManualAcceptor is implemented by handlers which accept or reject their
+// channels themselves, with the Accept and Reject methods of the context. The
+// channels of other handlers are accepted before they are called.
+type ManualAcceptor interface {
+	ManualAccept() bool
+}
+
+// ManualAccept returns a handler which accepts or rejects its channels itself,
+// see ManualAcceptor.
+func ManualAccept(h Handler) Handler {
+	return &manualHandler{Handler: h}
+}
+
+type manualHandler struct {
+	Handler
+	Manual
+}
+
+// Manual implements ManualAcceptor for the handlers embedding it.
+type Manual struct{}
+
+func (Manual) ManualAccept() bool {
+	return true
+}
+
+// IsManual returns true if the handler accepts or rejects its channels itself.
+func IsManual(h interface{}) bool {
+	m, ok := h.(ManualAcceptor)
+	return ok && m.ManualAccept()
+}
+
+// AutoAccept returns a handler which accepts the channel before calling h. It
+// lets a ManualAcceptor accept the channel once its own checks passed, as in
+// ManualAccept(checkUser(AutoAccept(h))).
+func AutoAccept(h Handler) Handler {
+	return &acceptHandler{h}
+}
+
+// accepting returns the handler of a route, which accepts the channel before
+// calling the handler unless it is a ManualAcceptor.
+func accepting(h Handler) Handler {
+	if IsManual(h) {
+		return h
+	}
+	return AutoAccept(h)
+}
+
+type acceptHandler struct {
+	handle Handler
+}
+
+func (h *acceptHandler) Handle(c *UrlContext) error {
+	if err := c.AutoAccept(); err != nil {
+		return err
+	}
+	return h.handle.Handle(c)
+}
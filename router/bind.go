@@ -0,0 +1,172 @@
+package router
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ErrBindTarget is returned by Bind when it is not given a pointer to a
+// struct.
+var ErrBindTarget = errors.New("router: Bind needs a pointer to a struct")
+
+// ErrBindField is returned by Bind when a tagged field has a type it cannot
+// decode into. Unlike ErrInvalidParam and ErrInvalidValue, it is not caused by
+// the client but by the struct given to Bind.
+type ErrBindField struct {
+	Field string
+	Type  string
+}
+
+func (e *ErrBindField) Error() string {
+	return fmt.Sprintf("router: cannot bind field %s of type %s", e.Field, e.Type)
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Bind decodes the parameters and the query values of the context into the
+// fields of the struct v points to, tagged with `param:"name"` or
+// `query:"name"`:
+//
+//	var args struct {
+//		ID    int           `param:"id"`
+//		Limit int           `query:"limit"`
+//		Wait  time.Duration `query:"wait"`
+//		Tags  []string      `query:"tag"`
+//	}
+//	err := router.Bind(ctx, &args)
+//
+// Fields can be strings, booleans, numbers, durations, encoding.TextUnmarshaler
+// implementations or, for query values, slices of these. Fields whose name is
+// not given keep their value. Values which cannot be decoded return an
+// ErrInvalidParam or an ErrInvalidValue, and tagged fields of other types an
+// ErrBindField.
+func Bind(c *UrlContext, v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Struct {
+		return ErrBindTarget
+	}
+	s := ptr.Elem()
+	for i := 0; i < s.NumField(); i++ {
+		field := s.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name := field.Tag.Get("param"); name != "" {
+			if !bindable(field.Type) {
+				return &ErrBindField{Field: field.Name, Type: field.Type.String()}
+			}
+			value := c.Params.ByName(name)
+			if value == "" {
+				continue
+			} else if err := decode(s.Field(i), value); err != nil {
+				return &ErrInvalidParam{Name: name, Value: value, Constraint: field.Type.String()}
+			}
+		}
+
+		if name := field.Tag.Get("query"); name != "" {
+			if !bindable(field.Type) && (field.Type.Kind() != reflect.Slice || !bindable(field.Type.Elem())) {
+				return &ErrBindField{Field: field.Name, Type: field.Type.String()}
+			}
+			values := c.Values[name]
+			if len(values) == 0 {
+				continue
+			}
+			if err := decodeAll(s.Field(i), values); err != nil {
+				return &ErrInvalidValue{Name: name, Value: err.value, Constraint: field.Type.String()}
+			}
+		}
+	}
+	return nil
+}
+
+// bindable returns true if values can be decoded into fields of the type.
+func bindable(t reflect.Type) bool {
+	if t == durationType || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// decodeError holds the value which could not be decoded.
+type decodeError struct {
+	value string
+}
+
+// decodeAll decodes the values into a slice, or the first one into other
+// fields.
+func decodeAll(field reflect.Value, values []string) *decodeError {
+	if field.Kind() != reflect.Slice || field.Addr().Type().Implements(textUnmarshalerType) {
+		if err := decode(field, values[0]); err != nil {
+			return &decodeError{values[0]}
+		}
+		return nil
+	}
+	slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+	for i, value := range values {
+		if err := decode(slice.Index(i), value); err != nil {
+			return &decodeError{value}
+		}
+	}
+	field.Set(slice)
+	return nil
+}
+
+// decode parses the value according to the type of the field, which is
+// bindable, and sets it.
+func decode(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	} else if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBind(t *testing.T) {
+	type args struct {
+		ID      int           `param:"id"`
+		Name    string        `param:"name"`
+		Limit   uint8         `query:"limit"`
+		Ratio   float64       `query:"ratio"`
+		Verbose bool          `query:"verbose"`
+		Wait    time.Duration `query:"wait"`
+		Tags    []string      `query:"tag"`
+		Ports   []int         `query:"port"`
+		Addr    net.IP        `query:"addr"`
+		Default string        `query:"default"`
+		ignored string        `query:"ignored"`
+	}
+
+	values, _ := url.ParseQuery("limit=10&ratio=0.5&verbose=true&wait=1m&tag=a&tag=b&port=22&port=80&addr=10.0.0.1&ignored=x")
+	c := &UrlContext{
+		Params: Params{{"id", "42"}, {"name", "db"}},
+		Values: values,
+	}
+	a := args{Default: "kept"}
+	if err := Bind(c, &a); err != nil {
+		t.Fatal(err)
+	}
+	expected := args{
+		ID:      42,
+		Name:    "db",
+		Limit:   10,
+		Ratio:   0.5,
+		Verbose: true,
+		Wait:    time.Minute,
+		Tags:    []string{"a", "b"},
+		Ports:   []int{22, 80},
+		Addr:    net.ParseIP("10.0.0.1"),
+		Default: "kept",
+	}
+	if !reflect.DeepEqual(expected, a) {
+		t.Errorf("expected %+v, got %+v", expected, a)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	var a struct {
+		ID    int   `param:"id"`
+		Limit uint8 `query:"limit"`
+	}
+
+	c := &UrlContext{Params: Params{{"id", "abc"}}}
+	expected := &ErrInvalidParam{"id", "abc", "int"}
+	if err := Bind(c, &a); !reflect.DeepEqual(expected, err) {
+		t.Errorf("expected %v, got %v", expected, err)
+	}
+
+	c = &UrlContext{Values: url.Values{"limit": {"300"}}}
+	if err := Bind(c, &a); !reflect.DeepEqual(&ErrInvalidValue{"limit", "300", "uint8"}, err) {
+		t.Errorf("expected an ErrInvalidValue, got %v", err)
+	}
+
+	if err := Bind(c, a); err != ErrBindTarget {
+		t.Errorf("expected ErrBindTarget, got %v", err)
+	}
+}
+
+func TestBindUnsupportedField(t *testing.T) {
+	var p struct {
+		Tags []string `param:"tags"`
+	}
+	var q struct {
+		Limits map[string]int `query:"limits"`
+	}
+
+	// The field is checked even when the client gives no value for it
+	c := &UrlContext{}
+	if err := Bind(c, &p); !reflect.DeepEqual(&ErrBindField{"Tags", "[]string"}, err) {
+		t.Errorf("expected an ErrBindField, got %v", err)
+	}
+	if err := Bind(c, &q); !reflect.DeepEqual(&ErrBindField{"Limits", "map[string]int"}, err) {
+		t.Errorf("expected an ErrBindField, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrRouteConflict is returned when a route conflicts with the wildcards of an
+// existing route, such as /db/:id with /db/:name.
+type ErrRouteConflict struct {
+
+	// Path is the route which could not be registered.
+	Path string
+
+	// Existing is the registered route it conflicts with.
+	Existing string
+
+	// Reason describes the conflict.
+	Reason string
+}
+
+func (e *ErrRouteConflict) Error() string {
+	return fmt.Sprintf("router: %s in path '%s', conflicts with existing route '%s'", e.Reason, e.Path, e.Existing)
+}
+
+// ErrDuplicateRoute is returned when a handler is already registered for the
+// route.
+type ErrDuplicateRoute struct {
+
+	// Path is the route which could not be registered.
+	Path string
+
+	// Existing is the registered route with the same path.
+	Existing string
+}
+
+func (e *ErrDuplicateRoute) Error() string {
+	return fmt.Sprintf("router: a handle is already registered for path '%s'", e.Existing)
+}
+
+// ErrInvalidRoute is returned when a route is malformed, such as a wildcard
+// without a name.
+type ErrInvalidRoute struct {
+
+	// Path is the route which could not be registered.
+	Path string
+
+	// Reason describes what is wrong with the route.
+	Reason string
+}
+
+func (e *ErrInvalidRoute) Error() string {
+	return fmt.Sprintf("router: %s in path '%s'", e.Reason, e.Path)
+}
+
+// validate checks the wildcards of the path, whatever the routes already
+// registered.
+func validate(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return &ErrInvalidRoute{Path: path, Reason: "path must begin with '/'"}
+	}
+	segments := strings.Split(path[1:], "/")
+	for i, segment := range segments {
+		start := strings.IndexAny(segment, ":*")
+		switch {
+		case start < 0:
+		case strings.IndexAny(segment[start+1:], ":*") >= 0:
+			return &ErrInvalidRoute{Path: path, Reason: "only one wildcard per path segment is allowed, has: '" + segment[start:] + "'"}
+		case start == len(segment)-1:
+			return &ErrInvalidRoute{Path: path, Reason: "wildcards must be named with a non-empty name"}
+		case segment[start] == '*' && i < len(segments)-1:
+			return &ErrInvalidRoute{Path: path, Reason: "catch-all routes are only allowed at the end of the path"}
+		case segment[start] == '*' && start > 0:
+			return &ErrInvalidRoute{Path: path, Reason: "no / before catch-all"}
+		}
+	}
+	return nil
+}
+
+// ErrInvalidParam is returned by Handle when a route parameter does not match
+// its constraint, such as /db/abc for /db/:id<int>.
+type ErrInvalidParam struct {
+	Name       string
+	Value      string
+	Constraint string
+}
+
+func (e *ErrInvalidParam) Error() string {
+	return fmt.Sprintf("router: parameter '%s' is not a valid %s: '%s'", e.Name, e.Constraint, e.Value)
+}
+
+// ErrInvalidValue is returned by Handle when a query value does not match its
+// constraint.
+type ErrInvalidValue struct {
+	Name       string
+	Value      string
+	Constraint string
+}
+
+func (e *ErrInvalidValue) Error() string {
+	return fmt.Sprintf("router: query value '%s' is not a valid %s: '%s'", e.Name, e.Constraint, e.Value)
+}
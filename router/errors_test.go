@@ -0,0 +1,71 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTryRegister(t *testing.T) {
+	r := New(nil, nil, nil)
+	for _, path := range []string{"/db/:name/query", "/db/:name/backup", "/files/*path"} {
+		if err := r.TryRegister(path, &NoopHandler{}); err != nil {
+			t.Fatalf("unexpected error for '%s': %v", path, err)
+		}
+	}
+	before := r.root.clone()
+
+	// Duplicates carry the existing route
+	err := r.TryRegister("/db/:name/query", &NoopHandler{})
+	if dup, ok := err.(*ErrDuplicateRoute); !ok || dup.Existing != "/db/:name/query" {
+		t.Errorf("expected ErrDuplicateRoute, got %#v", err)
+	}
+
+	// Conflicts carry the existing route
+	err = r.TryRegister("/db/:id/status", &NoopHandler{})
+	if conflict, ok := err.(*ErrRouteConflict); !ok || conflict.Existing != "/db/:name/query" {
+		t.Errorf("expected ErrRouteConflict, got %#v", err)
+	}
+	err = r.TryRegister("/files/readme", &NoopHandler{})
+	if conflict, ok := err.(*ErrRouteConflict); !ok || conflict.Existing != "/files/*path" {
+		t.Errorf("expected ErrRouteConflict, got %#v", err)
+	}
+
+	// The existing route is the one the tree conflicts with
+	tree := New(nil, nil, nil)
+	tree.Register("/src/", &NoopHandler{})
+	tree.Register("/src/main", &NoopHandler{})
+	err = tree.TryRegister("/src/*path", &NoopHandler{})
+	if conflict, ok := err.(*ErrRouteConflict); !ok || conflict.Existing != "/src/main" {
+		t.Errorf("expected ErrRouteConflict with /src/main, got %#v", err)
+	}
+
+	// Malformed routes are invalid
+	for _, path := range []string{"/db/:", "/db/:a:b", "/files/*path/more", "/files/a*path", "db"} {
+		if _, ok := r.TryRegister(path, &NoopHandler{}).(*ErrInvalidRoute); !ok {
+			t.Errorf("expected ErrInvalidRoute for '%s'", path)
+		}
+	}
+
+	// The tree is unchanged by the failures
+	if !reflect.DeepEqual(before, r.root.clone()) {
+		t.Errorf("tree should be unchanged when registration fails")
+	}
+	if err := r.TryRegister("/db/:name/restore", &NoopHandler{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(r.routes) != 4 {
+		t.Errorf("expected 4 routes, got %d", len(r.routes))
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	r := New(nil, nil, nil)
+	r.Register("/echo", &NoopHandler{})
+
+	recv := catchPanic(func() {
+		r.Register("/echo", &NoopHandler{})
+	})
+	if _, ok := recv.(*ErrDuplicateRoute); !ok {
+		t.Errorf("expected Register to panic with ErrDuplicateRoute, got %v", recv)
+	}
+}
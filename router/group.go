@@ -0,0 +1,148 @@
+package router
+
+import "strings"
+
+// Middleware wraps a Handler to run code around it, such as to check the
+// permissions of the user, log channels or recover panics.
+type Middleware func(Handler) Handler
+
+// chain wraps the handler with the middleware, the first one outermost.
+func chain(handle Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handle = middleware[i](handle)
+	}
+	return handle
+}
+
+// Group registers routes which share a path prefix and middleware. Middleware
+// added to a group with Use applies to the routes registered afterwards.
+type Group struct {
+	router     *Router
+	parent     *Group
+	prefix     string
+	middleware []Middleware
+}
+
+// Group returns a group of routes under the path prefix, such as "/v1".
+func (r *Router) Group(prefix string) *Group {
+	return &Group{router: r, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// With returns a group of routes using the middleware, after the middleware of
+// the router.
+func (r *Router) With(mw ...Middleware) *Group {
+	return &Group{router: r, middleware: mw}
+}
+
+// Group returns a group of routes under the path prefix, within this group.
+func (g *Group) Group(prefix string) *Group {
+	return &Group{router: g.router, parent: g, prefix: g.prefix + strings.TrimSuffix(prefix, "/")}
+}
+
+// With returns a group of routes using the middleware, after the middleware of
+// this group.
+func (g *Group) With(mw ...Middleware) *Group {
+	return &Group{router: g.router, parent: g, prefix: g.prefix, middleware: mw}
+}
+
+// Use adds middleware to the routes registered on the group afterwards,
+// including those of its subgroups. Like Router.Use, it does not change the
+// routes already registered.
+func (g *Group) Use(mw ...Middleware) {
+	g.middleware = append(g.middleware, mw...)
+}
+
+// Register registers a handler for the path under the prefix of the group,
+// with the middleware of the group, then the middleware given. Like
+// Router.Register, it panics if the path is invalid or conflicts with an
+// existing route, see TryRegister.
+func (g *Group) Register(path string, handle Handler, mw ...Middleware) {
+	if err := g.TryRegister(path, handle, mw...); err != nil {
+		panic(err)
+	}
+}
+
+// TryRegister registers a handler for the path under the prefix of the group,
+// see Register. Like Router.TryRegister, it returns an error if the path is
+// invalid or conflicts with an existing route.
+func (g *Group) TryRegister(path string, handle Handler, mw ...Middleware) error {
+	return g.router.add(route{path: g.prefix + path, handle: g.chain(chain(accepting(handle), mw))})
+}
+
+// RegisterFunc registers a handler function, see Register.
+func (g *Group) RegisterFunc(path string, handle HandlerFunc, mw ...Middleware) {
+	g.Register(path, handle, mw...)
+}
+
+// Mount registers the routes of another router under the path prefix of the
+// group, see Router.Mount.
+func (g *Group) Mount(prefix string, sub *Router) error {
+	return g.router.mount(g.prefix+strings.TrimSuffix(prefix, "/"), sub, g)
+}
+
+// Mount registers the routes of another router under the path prefix, so
+// routers developed separately can be served together. The routes keep the
+// middleware of the other router, after the middleware of this one. Routes
+// registered on the other router afterwards are not added, and its NotFound
+// and PanicHandler are not used. If any route conflicts, none is added.
+func (r *Router) Mount(prefix string, sub *Router) error {
+	return r.mount(strings.TrimSuffix(prefix, "/"), sub, nil)
+}
+
+func (r *Router) mount(prefix string, sub *Router, g *Group) error {
+	sub.mu.RLock()
+	subRoutes := sub.routes
+	sub.mu.RUnlock()
+
+	routes := make([]route, 0, len(subRoutes))
+	for _, rt := range subRoutes {
+		handle := rt.handle
+		if g != nil {
+			handle = g.chain(handle)
+		}
+		routes = append(routes, route{path: prefix + rt.path, handle: handle, opts: rt.opts})
+	}
+	return r.add(routes...)
+}
+
+// chain wraps the handler with the middleware of the group and of its parents,
+// the parents outermost. The chain is built once, when the route is registered.
+func (g *Group) chain(handle Handler) Handler {
+	for ; g != nil; g = g.parent {
+		handle = chain(handle, g.middleware)
+	}
+	return handle
+}
+
+// add registers the routes. Every route is checked before the tree is
+// changed, so the tree is unchanged on errors.
+func (r *Router) add(routes ...route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Routes added together must not conflict with each other either
+	batch := new(node)
+	compiled := make([]route, 0, len(routes))
+	for _, rt := range routes {
+		rt, err := compile(rt)
+		if err != nil {
+			return err
+		} else if err := r.root.checkRoute(rt.path); err != nil {
+			return err
+		} else if len(routes) > 1 {
+			if err := batch.addRoute(rt.path, rt.handle); err != nil {
+				return err
+			}
+		}
+		rt.handle = chain(rt.handle, r.middleware)
+		compiled = append(compiled, rt)
+	}
+
+	for _, rt := range compiled {
+		if err := r.root.addRoute(rt.path, rt.treeHandle()); err != nil {
+			return err
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// recordMiddleware appends its name to the calls before calling the handler.
+func recordMiddleware(calls *[]string, name string) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(c *UrlContext) error {
+			*calls = append(*calls, name)
+			return h.Handle(c)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var calls []string
+	r := New(nil, nil, nil)
+	r.Use(recordMiddleware(&calls, "global"))
+
+	record := func(name string) HandlerFunc {
+		return func(c *UrlContext) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+	r.RegisterFunc("/route", record("handler"), recordMiddleware(&calls, "route"))
+
+	api := r.With(recordMiddleware(&calls, "api"))
+	api.RegisterFunc("/api", record("handler"), recordMiddleware(&calls, "route"))
+	admin := api.With(recordMiddleware(&calls, "admin"))
+	admin.RegisterFunc("/admin", record("handler"))
+
+	// Middleware added later only applies to routes registered afterwards
+	api.Use(recordMiddleware(&calls, "late"))
+	r.Use(recordMiddleware(&calls, "global late"))
+	api.RegisterFunc("/late", record("handler"))
+
+	tests := []struct {
+		path  string
+		calls []string
+	}{
+		{"/route", []string{"global", "route", "handler"}},
+		{"/api", []string{"global", "api", "route", "handler"}},
+		{"/admin", []string{"global", "api", "admin", "handler"}},
+		{"/late", []string{"global", "global late", "api", "late", "handler"}},
+	}
+	for _, test := range tests {
+		calls = nil
+		if err := r.Handle(&UrlContext{Path: test.path, Context: context.Background()}); err != nil {
+			t.Errorf("%s: %v", test.path, err)
+		}
+		if !reflect.DeepEqual(test.calls, calls) {
+			t.Errorf("%s: expected %v, got %v", test.path, test.calls, calls)
+		}
+	}
+
+	// Conflicts panic like the router, unless TryRegister is used
+	if err := api.TryRegister("/api", record("handler")); err == nil {
+		t.Errorf("expected an error for a duplicate route")
+	}
+	if _, ok := catchPanic(func() { api.RegisterFunc("/api", record("handler")) }).(*ErrDuplicateRoute); !ok {
+		t.Errorf("expected Register to panic with ErrDuplicateRoute")
+	}
+}
+
+func TestGroupPrefix(t *testing.T) {
+	var calls []string
+	r := New(nil, nil, nil)
+	v1 := r.Group("/v1/")
+	db := v1.Group("/db/:name")
+	db.Use(recordMiddleware(&calls, "db"))
+	db.RegisterFunc("/query", func(c *UrlContext) error {
+		calls = append(calls, c.Params.ByName("name"))
+		return nil
+	})
+
+	if err := r.Handle(&UrlContext{Path: "/v1/db/users/query", Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"db", "users"}; !reflect.DeepEqual(expected, calls) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+
+	// Conflicting wildcards are errors
+	noop := HandlerFunc(func(c *UrlContext) error { return nil })
+	if err := v1.TryRegister("/db/:id/backup", noop); err == nil {
+		t.Errorf("expected an error for a conflicting wildcard")
+	}
+	if err := v1.TryRegister("db", noop); err != nil {
+		t.Errorf("prefixed paths should begin with '/': %v", err)
+	}
+	if err := r.With().TryRegister("db", noop); err == nil {
+		t.Errorf("expected an error for a path without '/'")
+	}
+}
+
+func TestMount(t *testing.T) {
+	var calls []string
+	record := func(name string) HandlerFunc {
+		return func(c *UrlContext) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+
+	db := New(nil, nil, nil)
+	db.Use(recordMiddleware(&calls, "db"))
+	db.RegisterFunc("/:name/query", record("query"))
+	db.RegisterFunc("/:name/backup", record("backup"))
+
+	r := New(nil, nil, nil)
+	r.Use(recordMiddleware(&calls, "global"))
+	if err := r.Mount("/v1/db", db); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Handle(&UrlContext{Path: "/v1/db/users/backup", Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"global", "db", "backup"}; !reflect.DeepEqual(expected, calls) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+
+	// Conflicting wildcards leave the router unchanged
+	other := New(nil, nil, nil)
+	other.RegisterFunc("/:id/status", record("status"))
+	if err := r.Mount("/v1/db", other); err == nil {
+		t.Errorf("expected an error for conflicting routes")
+	}
+	if r.HasRoute("/v1/db/users/status") {
+		t.Errorf("no route should be added when mounting fails")
+	}
+
+	// Groups mount under their prefix
+	if err := r.Group("/v2").Mount("/other", other); err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasRoute("/v2/other/users/status") {
+		t.Errorf("route should be mounted under the group prefix")
+	}
+}
@@ -13,25 +13,25 @@ type Handler interface {
 
 type HandlerFunc func(*UrlContext) error
 
-type basicHandler struct {
-	hf HandlerFunc
-}
-
-func (b *basicHandler) Handle(c *UrlContext) error {
-	return b.hf(c)
+// Handle calls f, so functions can be given where a Handler is needed.
+func (f HandlerFunc) Handle(c *UrlContext) error {
+	return f(c)
 }
 
 type PanicHandler interface {
 	Handle(*UrlContext, interface{})
 }
 
+// UrlContext is the channel handled by a route. The channel is accepted
+// before the handler is called, unless the handler accepts or rejects it
+// itself, see ManualAcceptor.
 type UrlContext struct {
-	Path     string
-	Params   Params
-	Values   url.Values
-	Context  context.Context
-	Channel  ssh.Channel
-	Requests <-chan *ssh.Request
+	Path    string
+	Params  Params
+	Values  url.Values
+	Context context.Context
+	Conn    *ssh.ServerConn
+	Acceptor
 }
 
 type Param struct {
@@ -0,0 +1,169 @@
+package router
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constraints are the checks which can be given to route parameters, as in
+// /db/:id<int>, and to query values with Options.
+var constraints = map[string]func(string) bool{
+	"int": func(s string) bool {
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err == nil
+	},
+	"uint": func(s string) bool {
+		_, err := strconv.ParseUint(s, 10, 64)
+		return err == nil
+	},
+	"float": func(s string) bool {
+		_, err := strconv.ParseFloat(s, 64)
+		return err == nil
+	},
+	"bool": func(s string) bool {
+		_, err := strconv.ParseBool(s)
+		return err == nil
+	},
+	"duration": func(s string) bool {
+		_, err := time.ParseDuration(s)
+		return err == nil
+	},
+	"uuid": isUUID,
+	"safe": isSafePath,
+}
+
+// isUUID checks for a UUID in its canonical form, such as
+// 123e4567-e89b-12d3-a456-426614174000.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if s[i] != '-' {
+				return false
+			}
+		case '0' <= s[i] && s[i] <= '9', 'a' <= s[i] && s[i] <= 'f', 'A' <= s[i] && s[i] <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isSafePath checks that a path stays under the directory it is joined to: it
+// has no empty, '.' or '..' element and no NUL byte.
+func isSafePath(s string) bool {
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return true
+	} else if strings.IndexByte(s, 0) >= 0 {
+		return false
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// compile moves the constraints of the path of the route, such as <int> in
+// /db/:id<int>, to its options and checks them. Constraints in the path take
+// precedence over the options.
+func compile(rt route) (route, error) {
+	pattern := rt.path
+	segments := strings.Split(pattern, "/")
+	params := make(map[string]string, len(rt.opts.Params))
+	for name, constraint := range rt.opts.Params {
+		params[name] = constraint
+	}
+	for i, segment := range segments {
+		start := strings.IndexAny(segment, ":*")
+		lt := strings.IndexByte(segment, '<')
+		switch {
+		case lt < 0 && strings.IndexByte(segment, '>') < 0:
+			continue
+		case start < 0 || lt < start || !strings.HasSuffix(segment, ">"):
+			return rt, &ErrInvalidRoute{Path: pattern, Reason: "constraints must follow a wildcard, as in ':id<int>'"}
+		}
+		params[segment[start+1:lt]] = segment[lt+1 : len(segment)-1]
+		segments[i] = segment[:lt]
+	}
+	rt.path = strings.Join(segments, "/")
+
+	names := paramNames(rt.path)
+	for name, constraint := range params {
+		if !contains(names, name) {
+			return rt, &ErrInvalidRoute{Path: pattern, Reason: "constraint for unknown parameter '" + name + "'"}
+		} else if _, ok := constraints[constraint]; !ok {
+			return rt, &ErrInvalidRoute{Path: pattern, Reason: "unknown constraint '" + constraint + "'"}
+		}
+	}
+	for _, constraint := range rt.opts.Values {
+		if _, ok := constraints[constraint]; !ok {
+			return rt, &ErrInvalidRoute{Path: pattern, Reason: "unknown constraint '" + constraint + "'"}
+		}
+	}
+	if len(params) > 0 {
+		rt.opts.Params = params
+	}
+	rt.opts.Values = copyMap(rt.opts.Values)
+	return rt, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// treeHandle returns the handler to add to the tree, which checks the
+// constraints of the route if it has any.
+func (rt route) treeHandle() Handler {
+	if len(rt.opts.Params) == 0 && len(rt.opts.Values) == 0 {
+		return rt.handle
+	}
+	return &constrainedHandler{rt.opts.Params, rt.opts.Values, rt.handle}
+}
+
+// constrainedHandler is a handler whose parameters and query values are
+// checked before the middleware of the router runs, so channels are rejected
+// before they could be accepted.
+type constrainedHandler struct {
+	params map[string]string
+	values map[string]string
+	handle Handler
+}
+
+func (h *constrainedHandler) Handle(c *UrlContext) error {
+	if err := h.check(c.Params, c.Values); err != nil {
+		return err
+	}
+	return h.handle.Handle(c)
+}
+
+// check returns an ErrInvalidParam or an ErrInvalidValue for the first
+// parameter or query value which does not match its constraint. Query values
+// which are not given are not checked.
+func (h *constrainedHandler) check(params Params, values url.Values) error {
+	for _, p := range params {
+		if constraint, ok := h.params[p.Key]; ok && !constraints[constraint](p.Value) {
+			return &ErrInvalidParam{Name: p.Key, Value: p.Value, Constraint: constraint}
+		}
+	}
+	for name, constraint := range h.values {
+		for _, value := range values[name] {
+			if !constraints[constraint](value) {
+				return &ErrInvalidValue{Name: name, Value: value, Constraint: constraint}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestConstraints(t *testing.T) {
+	tests := []struct {
+		constraint string
+		value      string
+		valid      bool
+	}{
+		{"int", "-42", true},
+		{"int", "4.2", false},
+		{"uint", "42", true},
+		{"uint", "-42", false},
+		{"float", "4.2", true},
+		{"bool", "true", true},
+		{"bool", "yes", false},
+		{"duration", "1m30s", true},
+		{"duration", "90", false},
+		{"uuid", "123e4567-e89b-12d3-a456-426614174000", true},
+		{"uuid", "123e4567e89b12d3a456426614174000", false},
+		{"uuid", "123e4567-e89b-12d3-a456-42661417400g", false},
+		{"safe", "/docs/readme.md", true},
+		{"safe", "/", true},
+		{"safe", "/docs/../../etc/passwd", false},
+		{"safe", "/docs//readme.md", false},
+		{"safe", "/docs/\x00", false},
+	}
+	for _, test := range tests {
+		if valid := constraints[test.constraint](test.value); valid != test.valid {
+			t.Errorf("%s %q: expected %v, got %v", test.constraint, test.value, test.valid, valid)
+		}
+	}
+}
+
+func TestParamConstraints(t *testing.T) {
+	var calls []string
+	r := New(nil, nil, nil)
+	r.Use(recordMiddleware(&calls, "global"))
+	r.Register("/db/:id<int>/query", &NoopHandler{})
+	r.Register("/file/*path<safe>", &NoopHandler{})
+	err := r.RegisterWith("/user/:id", &NoopHandler{}, Options{
+		Params: map[string]string{"id": "uuid"},
+		Values: map[string]string{"limit": "uint"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		query  string
+		err    error
+		called bool
+	}{
+		{"/db/42/query", "", nil, true},
+		{"/db/abc/query", "", &ErrInvalidParam{"id", "abc", "int"}, false},
+		{"/file/docs/readme.md", "", nil, true},
+		{"/file/docs/../../etc/passwd", "", &ErrInvalidParam{"path", "/docs/../../etc/passwd", "safe"}, false},
+		{"/user/123e4567-e89b-12d3-a456-426614174000", "limit=10", nil, true},
+		{"/user/123e4567-e89b-12d3-a456-426614174000", "limit=-1", &ErrInvalidValue{"limit", "-1", "uint"}, false},
+		{"/user/42", "", &ErrInvalidParam{"id", "42", "uuid"}, false},
+	}
+	for _, test := range tests {
+		calls = nil
+		values, _ := url.ParseQuery(test.query)
+		err := r.Handle(&UrlContext{Path: test.path, Values: values, Context: context.Background()})
+		if !reflect.DeepEqual(test.err, err) {
+			t.Errorf("%s?%s: expected %v, got %v", test.path, test.query, test.err, err)
+		}
+
+		// Middleware is not called for invalid channels
+		if called := len(calls) > 0; called != test.called {
+			t.Errorf("%s?%s: expected middleware called %v, got %v", test.path, test.query, test.called, called)
+		}
+	}
+
+	routes := r.Routes()
+	if routes[0].Path != "/db/:id/query" || !reflect.DeepEqual(routes[0].Constraints, map[string]string{"id": "int"}) {
+		t.Errorf("expected constraints to be listed, got %v", routes[0])
+	}
+}
+
+func TestInvalidConstraints(t *testing.T) {
+	tests := []struct {
+		path   string
+		opts   Options
+		reason string
+	}{
+		{"/db/:id<number>", Options{}, "unknown constraint"},
+		{"/db/:id<int", Options{}, "constraints must follow a wildcard"},
+		{"/db<int>", Options{}, "constraints must follow a wildcard"},
+		{"/db/:id", Options{Params: map[string]string{"name": "int"}}, "constraint for unknown parameter"},
+		{"/db/:id", Options{Values: map[string]string{"limit": "number"}}, "unknown constraint"},
+	}
+	for _, test := range tests {
+		r := New(nil, nil, nil)
+		err := r.RegisterWith(test.path, &NoopHandler{}, test.opts)
+		if e, ok := err.(*ErrInvalidRoute); !ok || !strings.HasPrefix(e.Reason, test.reason) {
+			t.Errorf("%s: expected %q, got %v", test.path, test.reason, err)
+		}
+	}
+
+	// Constraints do not change which routes conflict
+	r := New(nil, nil, nil)
+	r.Register("/db/:id<int>", &NoopHandler{})
+	if err := r.TryRegister("/db/:name", &NoopHandler{}); err == nil {
+		t.Errorf("expected a conflict")
+	}
+	if err := r.TryRegister("/db/:id<uuid>", &NoopHandler{}); err == nil {
+		t.Errorf("expected a duplicate route")
+	}
+}
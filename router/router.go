@@ -2,12 +2,24 @@ package router
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 
 	log "github.com/mgutz/logxi/v1"
 )
 
 var ErrUnknownChannel = errors.New("Unknown channel type")
 
+// PanicError is returned by Handle when a handler panicked, once the
+// PanicHandler has recovered it.
+type PanicError struct {
+	Value interface{}
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.Value)
+}
+
 func New(l log.Logger, panicHandler PanicHandler, notFound Handler) *Router {
 	return &Router{
 		root: new(node),
@@ -18,28 +30,64 @@ func New(l log.Logger, panicHandler PanicHandler, notFound Handler) *Router {
 }
 
 type Router struct {
+	mu           sync.RWMutex
 	root         *node
 	logger       log.Logger
+	middleware   []Middleware
+	routes       []route
 	PanicHandler PanicHandler
 	NotFound     Handler
 }
 
-func (r *Router) Register(path string, handle Handler) {
-	r.root.addRoute(path, handle)
+// route is a registered path, its handler and its options.
+type route struct {
+	path   string
+	handle Handler
+	opts   Options
 }
 
-func (r *Router) RegisterFunc(path string, handle HandlerFunc) {
-	r.Register(path, &basicHandler{handle})
+// Use adds middleware to the routes registered afterwards and to the NotFound
+// handler, the first one outermost. Like Group.Use, it does not change the
+// routes already registered.
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
 }
 
-func (r *Router) HasRoute(path string) bool {
-	if handler, _, _ := r.root.getValue(path); handler != nil {
-		return true
+// Register registers a handler for the path, wrapped with the middleware
+// given. It panics if the path is invalid or conflicts with an existing route,
+// see TryRegister. The channel is accepted after the middleware, before the
+// handler is called, unless the handler is a ManualAcceptor. Routes may be
+// registered while channels are handled.
+func (r *Router) Register(path string, handle Handler, mw ...Middleware) {
+	if err := r.TryRegister(path, handle, mw...); err != nil {
+		panic(err)
 	}
-	return false
+}
+
+// TryRegister registers a handler for the path, wrapped with the middleware
+// given. If the path conflicts with an existing route, it returns an
+// ErrRouteConflict or an ErrDuplicateRoute holding the existing path. If the
+// path is malformed, it returns an ErrInvalidRoute. The router is unchanged
+// when registration fails. Parameters can be constrained in the path, as in
+// /db/:id<int>, see Options.
+func (r *Router) TryRegister(path string, handle Handler, mw ...Middleware) error {
+	return r.add(route{path: path, handle: chain(accepting(handle), mw)})
+}
+
+func (r *Router) RegisterFunc(path string, handle HandlerFunc, mw ...Middleware) {
+	r.Register(path, handle, mw...)
+}
+
+func (r *Router) HasRoute(path string) bool {
+	_, _, ok := r.GetRoute(path)
+	return ok
 }
 
 func (r *Router) GetRoute(path string) (Handler, Params, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if handler, params, _ := r.root.getValue(path); handler != nil {
 		return handler, params, true
 	}
@@ -49,15 +97,21 @@ func (r *Router) GetRoute(path string) (Handler, Params, bool) {
 func (r *Router) callRoute(c *UrlContext) (err error, called bool) {
 	if handler, params, ok := r.GetRoute(c.Path); ok {
 		c.Params = params
+		if h, ok := handler.(*constrainedHandler); ok {
+			if err = h.check(params, c.Values); err != nil {
+				return err, true
+			}
+			handler = h.handle
+		}
 		err = handler.Handle(c)
 		called = true
 	}
 	return
 }
 
-func (r *Router) Handle(c *UrlContext) error {
+func (r *Router) Handle(c *UrlContext) (err error) {
 	if r.PanicHandler != nil {
-		defer r.recv(c)
+		defer r.recv(c, &err)
 	}
 
 	err, ok := r.callRoute(c)
@@ -66,7 +120,9 @@ func (r *Router) Handle(c *UrlContext) error {
 	} else if c.Path != "/" {
 
 		// Try to fix the request path
+		r.mu.RLock()
 		fixedPath, found := r.root.findCaseInsensitivePath(CleanPath(c.Path), true)
+		r.mu.RUnlock()
 		if found {
 			c.Path = string(fixedPath)
 			err, ok = r.callRoute(c)
@@ -78,15 +134,19 @@ func (r *Router) Handle(c *UrlContext) error {
 
 	// Handle unknown path
 	if r.NotFound != nil {
-		r.NotFound.Handle(c)
+		r.mu.RLock()
+		middleware := r.middleware
+		r.mu.RUnlock()
+		chain(accepting(r.NotFound), middleware).Handle(c)
 	} else {
 		return ErrUnknownChannel
 	}
 	return nil
 }
 
-func (r *Router) recv(c *UrlContext) {
+func (r *Router) recv(c *UrlContext, err *error) {
 	if rcv := recover(); rcv != nil {
 		r.PanicHandler.Handle(c, rcv)
+		*err = &PanicError{rcv}
 	}
 }
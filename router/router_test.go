@@ -1,6 +1,9 @@
 package router
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 import "golang.org/x/net/context"
 
@@ -15,11 +18,9 @@ func BenchmarkHandleSingle(b *testing.B) {
 	r := New(nil, nil, nil)
 	r.Register("/noop", &NoopHandler{})
 	ctx := UrlContext{
-		Path:     "/noop",
-		Params:   nil,
-		Context:  context.Background(),
-		Channel:  nil,
-		Requests: nil,
+		Path:    "/noop",
+		Params:  nil,
+		Context: context.Background(),
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -31,11 +32,9 @@ func BenchmarkHandleLong(b *testing.B) {
 	r := New(nil, nil, nil)
 	r.Register("/repos/:owner/:repo/issues/:number/comments", &NoopHandler{})
 	ctx := UrlContext{
-		Path:     "/repos/:owner/:repo/issues/:number/comments",
-		Params:   nil,
-		Context:  context.Background(),
-		Channel:  nil,
-		Requests: nil,
+		Path:    "/repos/:owner/:repo/issues/:number/comments",
+		Params:  nil,
+		Context: context.Background(),
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -50,11 +49,81 @@ func TestParams(t *testing.T) {
 		return nil
 	})
 	ctx := UrlContext{
-		Path:     "/repos/eliquious/32/issues/1/comments",
-		Params:   nil,
-		Context:  context.Background(),
-		Channel:  nil,
-		Requests: nil,
+		Path:    "/repos/eliquious/32/issues/1/comments",
+		Params:  nil,
+		Context: context.Background(),
 	}
 	r.Handle(&ctx)
 }
+
+type panicHandler struct {
+	value interface{}
+}
+
+func (p *panicHandler) Handle(c *UrlContext, rcv interface{}) {
+	p.value = rcv
+}
+
+func TestPanicError(t *testing.T) {
+	panics := &panicHandler{}
+	r := New(nil, panics, nil)
+	r.RegisterFunc("/panic", func(ctx *UrlContext) error {
+		panic("oops")
+	})
+
+	err := r.Handle(&UrlContext{Path: "/panic", Context: context.Background()})
+	if p, ok := err.(*PanicError); !ok || p.Value != "oops" {
+		t.Errorf("expected a PanicError, got %v", err)
+	}
+	if panics.value != "oops" {
+		t.Errorf("PanicHandler should be called")
+	}
+}
+
+func TestNotFoundAccepted(t *testing.T) {
+	r := New(nil, nil, HandlerFunc(func(ctx *UrlContext) error {
+		if ctx.Channel == nil {
+			t.Errorf("channel should be accepted before the NotFound handler")
+		}
+		return nil
+	}))
+
+	ctx := &UrlContext{Path: "/missing", Context: context.Background(), Acceptor: Acceptor{NewChannel: &acceptChannel{&bufferChannel{}}}}
+	if err := r.Handle(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	r := New(nil, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r.RegisterFunc("/r/"+strconv.Itoa(i), func(ctx *UrlContext) error {
+				return nil
+			})
+		}
+	}()
+
+	// Routes are looked up while others are registered
+	for routing := true; routing; {
+		select {
+		case <-done:
+			routing = false
+		default:
+		}
+		if err := r.Handle(&UrlContext{Path: "/missing", Context: context.Background()}); err != ErrUnknownChannel {
+			t.Fatalf("expected ErrUnknownChannel, got %v", err)
+		}
+		r.HasRoute("/r/0")
+		r.Routes()
+	}
+
+	if n := len(r.Routes()); n != 100 {
+		t.Errorf("expected 100 routes, got %d", n)
+	}
+	if !r.HasRoute("/r/99") {
+		t.Errorf("route should be registered")
+	}
+}
@@ -0,0 +1,133 @@
+package router
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RoutesPath is the path usually given to the RoutesHandler.
+const RoutesPath = "/_routes"
+
+// Options are the optional settings of a route.
+type Options struct {
+
+	// Description describes what the route does.
+	Description string
+
+	// Permissions lists the permissions a user needs to open the route,
+	// such as ssh.Permissions extensions. They are only listed by Routes:
+	// use middleware to enforce them.
+	Permissions []string
+
+	// Params maps route parameters to their constraint, as an alternative to
+	// giving it in the path, such as "int" for /db/:id. The constraints are
+	// int, uint, float, bool, duration, uuid and safe, a path without '..'
+	// elements. Channels whose parameters do not match are rejected before
+	// the handler and its middleware run.
+	Params map[string]string
+
+	// Values maps query values to their constraint, checked when given.
+	Values map[string]string
+
+	// Middleware wraps the handler, the first one outermost.
+	Middleware []Middleware
+}
+
+// Route describes a registered route.
+type Route struct {
+	Path        string   `json:"path"`
+	Params      []string `json:"params,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+
+	// Constraints and Values are the constraints of the parameters and of
+	// the query values of the route.
+	Constraints map[string]string `json:"constraints,omitempty"`
+	Values      map[string]string `json:"values,omitempty"`
+}
+
+// RegisterWith registers a handler for the path with the options. Like
+// TryRegister, it returns an error if the path is invalid or conflicts with an
+// existing route.
+func (r *Router) RegisterWith(path string, handle Handler, opts Options) error {
+	return r.add(newRoute(path, chain(accepting(handle), opts.Middleware), opts))
+}
+
+// RegisterWith registers a handler for the path under the prefix of the group
+// with the options, see Register.
+func (g *Group) RegisterWith(path string, handle Handler, opts Options) error {
+	return g.router.add(newRoute(g.prefix+path, g.chain(chain(accepting(handle), opts.Middleware)), opts))
+}
+
+// Routes returns the registered routes, sorted by path.
+func (r *Router) Routes() []Route {
+	r.mu.RLock()
+	registered := r.routes
+	r.mu.RUnlock()
+
+	routes := make([]Route, 0, len(registered))
+	for _, rt := range registered {
+		info := Route{
+			Path:        rt.path,
+			Params:      paramNames(rt.path),
+			Description: rt.opts.Description,
+			Permissions: append([]string(nil), rt.opts.Permissions...),
+			Constraints: copyMap(rt.opts.Params),
+			Values:      copyMap(rt.opts.Values),
+		}
+		routes = append(routes, info)
+	}
+	sort.Sort(routesByPath(routes))
+	return routes
+}
+
+// RoutesHandler returns a handler which accepts the channel and sends the
+// Routes of the router as JSON. It is not registered unless asked for:
+//
+//	r.Register(router.RoutesPath, r.RoutesHandler())
+func (r *Router) RoutesHandler() Handler {
+	return HandlerFunc(func(c *UrlContext) error {
+		channel, requests, err := c.Accept()
+		if err != nil {
+			return err
+		}
+		go ssh.DiscardRequests(requests)
+		return json.NewEncoder(channel).Encode(r.Routes())
+	})
+}
+
+func newRoute(path string, handle Handler, opts Options) route {
+	opts.Middleware = nil
+	return route{path: path, handle: handle, opts: opts}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// paramNames returns the names of the wildcards of the path.
+func paramNames(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if i := strings.IndexAny(segment, ":*"); i >= 0 {
+			names = append(names, segment[i+1:])
+		}
+	}
+	return names
+}
+
+type routesByPath []Route
+
+func (r routesByPath) Len() int           { return len(r) }
+func (r routesByPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r routesByPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
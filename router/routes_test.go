@@ -0,0 +1,99 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// bufferChannel is an ssh.Channel writing to a buffer.
+type bufferChannel struct {
+	bytes.Buffer
+}
+
+func (c *bufferChannel) Close() error      { return nil }
+func (c *bufferChannel) CloseWrite() error { return nil }
+func (c *bufferChannel) Stderr() io.ReadWriter {
+	return &bytes.Buffer{}
+}
+func (c *bufferChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return false, nil
+}
+
+// acceptChannel is an ssh.NewChannel accepted with its channel.
+type acceptChannel struct {
+	channel *bufferChannel
+}
+
+func (c *acceptChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	requests := make(chan *ssh.Request)
+	close(requests)
+	return c.channel, requests, nil
+}
+func (c *acceptChannel) Reject(ssh.RejectionReason, string) error { return nil }
+func (c *acceptChannel) ChannelType() string                      { return RoutesPath }
+func (c *acceptChannel) ExtraData() []byte                        { return nil }
+
+func TestRoutes(t *testing.T) {
+	r := New(nil, nil, nil)
+	r.Register("/status", &NoopHandler{})
+	err := r.RegisterWith("/db/:id/query", &NoopHandler{}, Options{
+		Description: "Queries a database",
+		Permissions: []string{"db-read"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := New(nil, nil, nil)
+	sub.RegisterWith("/*path", &NoopHandler{}, Options{Description: "Reads a file"})
+	if err := r.Group("/v1").Mount("/files", sub); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Route{
+		{Path: "/db/:id/query", Params: []string{"id"}, Description: "Queries a database", Permissions: []string{"db-read"}},
+		{Path: "/status"},
+		{Path: "/v1/files/*path", Params: []string{"path"}, Description: "Reads a file"},
+	}
+	if routes := r.Routes(); !reflect.DeepEqual(expected, routes) {
+		t.Errorf("expected %v, got %v", expected, routes)
+	}
+
+	// Invalid routes are not listed
+	if err := r.RegisterWith("/db/:name", &NoopHandler{}, Options{Description: "Conflicts"}); err == nil {
+		t.Errorf("expected a conflict")
+	}
+	if routes := r.Routes(); len(routes) != len(expected) {
+		t.Errorf("expected %d routes, got %v", len(expected), routes)
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	r := New(nil, nil, nil)
+	r.RegisterWith("/db/:id", &NoopHandler{}, Options{Description: "Opens a database"})
+	r.Register(RoutesPath, r.RoutesHandler())
+
+	channel := &bufferChannel{}
+	ctx := &UrlContext{Path: RoutesPath, Context: context.Background(), Acceptor: Acceptor{NewChannel: &acceptChannel{channel}}}
+	if err := r.Handle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var routes []Route
+	if err := json.Unmarshal(channel.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Route{
+		{Path: RoutesPath},
+		{Path: "/db/:id", Params: []string{"id"}, Description: "Opens a database"},
+	}
+	if !reflect.DeepEqual(expected, routes) {
+		t.Errorf("expected %v, got %v", expected, routes)
+	}
+}
@@ -76,9 +76,107 @@ func (n *node) incrementChildPrio(pos int) int {
 	return newPos
 }
 
-// addRoute adds a node with the given handle to the path.
+// routePath returns the path of the first route through the node, given the
+// path leading to it. Conflicts report it as the existing route.
+func (n *node) routePath(prefix string) string {
+	prefix += n.path
+	if n.handle != nil || len(n.children) == 0 {
+		return prefix
+	}
+	return n.children[0].routePath(prefix)
+}
+
+// checkRoute returns the ErrInvalidRoute, ErrRouteConflict or
+// ErrDuplicateRoute adding the path would cause, without changing the tree. It
+// follows the walk of addRoute.
+func (n *node) checkRoute(path string) error {
+	if err := validate(path); err != nil {
+		return err
+	}
+	fullPath := path
+
+	// empty tree
+	if len(n.path) == 0 && len(n.children) == 0 {
+		return nil
+	}
+
+	for {
+		i := 0
+		max := min(len(path), len(n.path))
+		for i < max && path[i] == n.path[i] {
+			i++
+		}
+		before := fullPath[:len(fullPath)-len(path)]
+
+		// The edge would be split, leaving the rest of it as the only child
+		if i < len(n.path) {
+			if i < len(path) && (path[i] == ':' || path[i] == '*') {
+				return &ErrRouteConflict{Path: fullPath, Existing: n.routePath(before),
+					Reason: "wildcard route '" + wildcard(path[i:]) + "' conflicts with existing children"}
+			}
+			return nil
+		}
+
+		if i == len(path) {
+			if n.handle != nil {
+				return &ErrDuplicateRoute{Path: fullPath, Existing: fullPath}
+			}
+			return nil
+		}
+		path = path[i:]
+
+		if n.wildChild {
+			n = n.children[0]
+			if len(path) >= len(n.path) && n.path == path[:len(n.path)] {
+				if len(n.path) >= len(path) || path[len(n.path)] == '/' {
+					continue
+				}
+			}
+			return &ErrRouteConflict{Path: fullPath, Existing: n.routePath(fullPath[:len(fullPath)-len(path)]),
+				Reason: "path segment '" + path + "' conflicts with existing wildcard '" + n.path + "'"}
+		}
+
+		c := path[0]
+		if n.nType == param && c == '/' && len(n.children) == 1 {
+			n = n.children[0]
+			continue
+		}
+		if i := strings.IndexByte(n.indices, c); i >= 0 {
+			n = n.children[i]
+			continue
+		}
+		if c != ':' && c != '*' {
+			return nil
+		}
+
+		// The wildcard would be inserted below the node
+		if len(n.children) > 0 {
+			return &ErrRouteConflict{Path: fullPath, Existing: n.children[0].routePath(fullPath[:len(fullPath)-len(path)]),
+				Reason: "wildcard route '" + wildcard(path) + "' conflicts with existing children"}
+		} else if c == '*' && len(n.path) > 0 && n.path[len(n.path)-1] == '/' {
+			return &ErrRouteConflict{Path: fullPath, Existing: n.routePath(before),
+				Reason: "catch-all conflicts with existing handle for the path segment root"}
+		}
+		return nil
+	}
+}
+
+// wildcard returns the wildcard the path begins with.
+func wildcard(path string) string {
+	if end := strings.IndexByte(path, '/'); end >= 0 {
+		return path[:end]
+	}
+	return path
+}
+
+// addRoute adds a node with the given handle to the path. It returns an
+// ErrInvalidRoute, ErrRouteConflict or ErrDuplicateRoute if the path cannot be
+// added, in which case the tree is unchanged, see checkRoute.
 // Not concurrency-safe!
-func (n *node) addRoute(path string, handle Handler) {
+func (n *node) addRoute(path string, handle Handler) error {
+	if err := n.checkRoute(path); err != nil {
+		return err
+	}
 	fullPath := path
 	n.priority++
 	numParams := countParams(path)
@@ -149,9 +247,8 @@ func (n *node) addRoute(path string, handle Handler) {
 						}
 					}
 
-					panic("path segment '" + path +
-						"' conflicts with existing wildcard '" + n.path +
-						"' in path '" + fullPath + "'")
+					return &ErrRouteConflict{Path: fullPath, Existing: n.routePath(fullPath[:len(fullPath)-len(path)]),
+						Reason: "path segment '" + path + "' conflicts with existing wildcard '" + n.path + "'"}
 				}
 
 				c := path[0]
@@ -183,25 +280,30 @@ func (n *node) addRoute(path string, handle Handler) {
 					n.incrementChildPrio(len(n.indices) - 1)
 					n = child
 				}
-				n.insertChild(numParams, path, fullPath, handle)
-				return
+				return n.insertChild(numParams, path, fullPath, handle)
 
 			} else if i == len(path) { // Make node a (in-path) leaf
 				if n.handle != nil {
-					panic("a handle is already registered for path '" + fullPath + "'")
+					return &ErrDuplicateRoute{Path: fullPath, Existing: fullPath}
 				}
 				n.handle = handle
 			}
-			return
+			return nil
 		}
 	} else { // Empty tree
-		n.insertChild(numParams, path, fullPath, handle)
+		if err := n.insertChild(numParams, path, fullPath, handle); err != nil {
+			return err
+		}
 		n.nType = root
 	}
+	return nil
 }
 
-func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handler) {
+// insertChild inserts the rest of the path below the node. It returns an
+// ErrInvalidRoute or ErrRouteConflict if the path cannot be inserted.
+func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handler) error {
 	var offset int // already handled bytes of the path
+	prefix := fullPath[:len(fullPath)-len(path)]
 
 	// find prefix until first wildcard (beginning with ':'' or '*'')
 	for i, max := 0, len(path); numParams > 0; i++ {
@@ -216,8 +318,8 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 			switch path[end] {
 			// the wildcard name must not contain ':' and '*'
 			case ':', '*':
-				panic("only one wildcard per path segment is allowed, has: '" +
-					path[i:] + "' in path '" + fullPath + "'")
+				return &ErrInvalidRoute{Path: fullPath, Reason: "only one wildcard per path segment is allowed, has: '" +
+					path[i:] + "'"}
 			default:
 				end++
 			}
@@ -226,13 +328,13 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 		// check if this Node existing children which would be
 		// unreachable if we insert the wildcard here
 		if len(n.children) > 0 {
-			panic("wildcard route '" + path[i:end] +
-				"' conflicts with existing children in path '" + fullPath + "'")
+			return &ErrRouteConflict{Path: fullPath, Existing: n.children[0].routePath(prefix),
+				Reason: "wildcard route '" + path[i:end] + "' conflicts with existing children"}
 		}
 
 		// check if the wildcard has a name
 		if end-i < 2 {
-			panic("wildcards must be named with a non-empty name in path '" + fullPath + "'")
+			return &ErrInvalidRoute{Path: fullPath, Reason: "wildcards must be named with a non-empty name"}
 		}
 
 		if c == ':' { // param
@@ -268,17 +370,18 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 
 		} else { // catchAll
 			if end != max || numParams > 1 {
-				panic("catch-all routes are only allowed at the end of the path in path '" + fullPath + "'")
+				return &ErrInvalidRoute{Path: fullPath, Reason: "catch-all routes are only allowed at the end of the path"}
 			}
 
 			if len(n.path) > 0 && n.path[len(n.path)-1] == '/' {
-				panic("catch-all conflicts with existing handle for the path segment root in path '" + fullPath + "'")
+				return &ErrRouteConflict{Path: fullPath, Existing: n.routePath(prefix[:len(prefix)-len(n.path)]),
+					Reason: "catch-all conflicts with existing handle for the path segment root"}
 			}
 
 			// currently fixed width 1 for '/'
 			i--
 			if path[i] != '/' {
-				panic("no / before catch-all in path '" + fullPath + "'")
+				return &ErrInvalidRoute{Path: fullPath, Reason: "no / before catch-all"}
 			}
 
 			n.path = path[offset:i]
@@ -304,13 +407,14 @@ func (n *node) insertChild(numParams uint8, path, fullPath string, handle Handle
 			}
 			n.children = []*node{child}
 
-			return
+			return nil
 		}
 	}
 
 	// insert remaining path part and handle to the leaf
 	n.path = path[offset:]
 	n.handle = handle
+	return nil
 }
 
 // Returns the handle registered with the given path (key). The values of
@@ -25,10 +25,10 @@ func printChildren(n *node, prefix string) {
 var fakeHandlerValue string
 
 func fakeHandler(val string) Handler {
-	return &basicHandler{func(*UrlContext) error {
+	return HandlerFunc(func(*UrlContext) error {
 		fakeHandlerValue = val
 		return nil
-	}}
+	})
 }
 
 type testRequests []struct {
@@ -198,6 +198,16 @@ func TestTreeWildcard(t *testing.T) {
 	checkMaxParams(t, tree)
 }
 
+// clone returns a deep copy of the node and its children.
+func (n *node) clone() *node {
+	c := *n
+	c.children = make([]*node, len(n.children))
+	for i, child := range n.children {
+		c.children[i] = child.clone()
+	}
+	return &c
+}
+
 func catchPanic(testFunc func()) (recv interface{}) {
 	defer func() {
 		recv = recover()
@@ -216,16 +226,17 @@ func testRoutes(t *testing.T, routes []testRoute) {
 	tree := &node{}
 
 	for _, route := range routes {
-		recv := catchPanic(func() {
-			tree.addRoute(route.path, nil)
-		})
+		before := tree.clone()
+		err := tree.addRoute(route.path, nil)
 
 		if route.conflict {
-			if recv == nil {
-				t.Errorf("no panic for conflicting route '%s'", route.path)
+			if err == nil {
+				t.Errorf("no error for conflicting route '%s'", route.path)
+			} else if !reflect.DeepEqual(before, tree.clone()) {
+				t.Errorf("tree changed by conflicting route '%s'", route.path)
 			}
-		} else if recv != nil {
-			t.Errorf("unexpected panic for route '%s': %v", route.path, recv)
+		} else if err != nil {
+			t.Errorf("unexpected error for route '%s': %v", route.path, err)
 		}
 	}
 
@@ -280,19 +291,13 @@ func TestTreeDupliatePath(t *testing.T) {
 		"/user_:name",
 	}
 	for _, route := range routes {
-		recv := catchPanic(func() {
-			tree.addRoute(route, fakeHandler(route))
-		})
-		if recv != nil {
-			t.Fatalf("panic inserting route '%s': %v", route, recv)
+		if err := tree.addRoute(route, fakeHandler(route)); err != nil {
+			t.Fatalf("error inserting route '%s': %v", route, err)
 		}
 
 		// Add again
-		recv = catchPanic(func() {
-			tree.addRoute(route, nil)
-		})
-		if recv == nil {
-			t.Fatalf("no panic while inserting duplicate route '%s", route)
+		if _, ok := tree.addRoute(route, nil).(*ErrDuplicateRoute); !ok {
+			t.Fatalf("no error while inserting duplicate route '%s", route)
 		}
 	}
 
@@ -317,11 +322,8 @@ func TestEmptyWildcardName(t *testing.T) {
 		"/src/*",
 	}
 	for _, route := range routes {
-		recv := catchPanic(func() {
-			tree.addRoute(route, nil)
-		})
-		if recv == nil {
-			t.Fatalf("no panic while inserting route with empty wildcard name '%s", route)
+		if _, ok := tree.addRoute(route, nil).(*ErrInvalidRoute); !ok {
+			t.Fatalf("no error while inserting route with empty wildcard name '%s", route)
 		}
 	}
 }
@@ -344,7 +346,7 @@ func TestTreeCatchAllConflictRoot(t *testing.T) {
 }
 
 func TestTreeDoubleWildcard(t *testing.T) {
-	const panicMsg = "only one wildcard per path segment is allowed"
+	const errMsg = "only one wildcard per path segment is allowed"
 
 	routes := [...]string{
 		"/:foo:bar",
@@ -354,12 +356,9 @@ func TestTreeDoubleWildcard(t *testing.T) {
 
 	for _, route := range routes {
 		tree := &node{}
-		recv := catchPanic(func() {
-			tree.addRoute(route, nil)
-		})
-
-		if rs, ok := recv.(string); !ok || !strings.HasPrefix(rs, panicMsg) {
-			t.Fatalf(`"Expected panic "%s" for route '%s', got "%v"`, panicMsg, route, recv)
+		err := tree.addRoute(route, nil)
+		if err, ok := err.(*ErrInvalidRoute); !ok || !strings.HasPrefix(err.Reason, errMsg) {
+			t.Fatalf(`"Expected error "%s" for route '%s', got "%v"`, errMsg, route, err)
 		}
 	}
 }
@@ -405,11 +404,8 @@ func TestTreeTrailingSlashRedirect(t *testing.T) {
 		"/api/hello/:name",
 	}
 	for _, route := range routes {
-		recv := catchPanic(func() {
-			tree.addRoute(route, fakeHandler(route))
-		})
-		if recv != nil {
-			t.Fatalf("panic inserting route '%s': %v", route, recv)
+		if err := tree.addRoute(route, fakeHandler(route)); err != nil {
+			t.Fatalf("error inserting route '%s': %v", route, err)
 		}
 	}
 
@@ -461,11 +457,8 @@ func TestTreeTrailingSlashRedirect(t *testing.T) {
 func TestTreeRootTrailingSlashRedirect(t *testing.T) {
 	tree := &node{}
 
-	recv := catchPanic(func() {
-		tree.addRoute("/:test", fakeHandler("/:test"))
-	})
-	if recv != nil {
-		t.Fatalf("panic inserting test route: %v", recv)
+	if err := tree.addRoute("/:test", fakeHandler("/:test")); err != nil {
+		t.Fatalf("error inserting test route: %v", err)
 	}
 
 	handler, _, tsr := tree.getValue("/")
@@ -505,11 +498,8 @@ func TestTreeFindCaseInsensitivePath(t *testing.T) {
 	}
 
 	for _, route := range routes {
-		recv := catchPanic(func() {
-			tree.addRoute(route, fakeHandler(route))
-		})
-		if recv != nil {
-			t.Fatalf("panic inserting route '%s': %v", route, recv)
+		if err := tree.addRoute(route, fakeHandler(route)); err != nil {
+			t.Fatalf("error inserting route '%s': %v", route, err)
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	log "github.com/mgutz/logxi/v1"
@@ -13,114 +14,288 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	// minAcceptBackoff is the first delay after a temporary accept error.
+	minAcceptBackoff = 5 * time.Millisecond
+
+	// defaultMaxAcceptBackoff caps the accept delay if the config has no MaxAcceptBackoff.
+	defaultMaxAcceptBackoff = time.Second
+)
+
 // New creates a new server with the given config. The server will call `cfg.SSHConfig()` to setup
-// the server. If an error occurs it will be returned. If the Bind address is empty or invalid
-// an error will be returned. If there is an error starting the TCP server, the error will be returned.
+// the server. If an error occurs it will be returned. If the Bind address is set, a TCP listener is
+// opened for it in addition to any of the config Listeners. If there is no Bind address and no
+// Listeners, or the Bind address is invalid, an error will be returned. If there is an error starting
+// the TCP server, the error will be returned.
 func New(cfg *Config) (server SSHServer, err error) {
 	if cfg.Context == nil {
 		return SSHServer{}, errors.New("Config has no context")
 	}
 
 	// Create ssh config for server
-	sshConfig := cfg.SSHConfig()
-	cfg.sshConfig = sshConfig
+	if err = cfg.prepare(); err != nil {
+		return
+	}
 
 	// Validate the ssh bind addr
-	if cfg.Bind == "" {
+	if cfg.Bind == "" && len(cfg.Listeners) == 0 {
 		err = fmt.Errorf("ssh server: Empty SSH bind address")
 		return
 	}
 
-	// Open SSH socket listener
-	sshAddr, e := net.ResolveTCPAddr("tcp", cfg.Bind)
-	if e != nil {
-		err = fmt.Errorf("ssh server: Invalid tcp address")
-		return
+	listeners := append([]net.Listener{}, cfg.Listeners...)
+	if cfg.Bind != "" {
+
+		// Open SSH socket listener
+		sshAddr, e := net.ResolveTCPAddr("tcp", cfg.Bind)
+		if e != nil {
+			err = fmt.Errorf("ssh server: Invalid tcp address")
+			return
+		}
+
+		// Create listener
+		listener, e := net.ListenTCP("tcp", sshAddr)
+		if e != nil {
+			err = e
+			return
+		}
+		listeners = append(listeners, listener)
 	}
 
-	// Create listener
-	listener, e := net.ListenTCP("tcp", sshAddr)
-	if e != nil {
-		err = e
-		return
+	for _, l := range listeners {
+		server.Addr = append(server.Addr, l.Addr())
 	}
-	server.listener = listener
-	server.Addr = listener.Addr().(*net.TCPAddr)
-	server.config = cfg
+	server.listeners = listeners
+	server.current = new(atomic.Value)
+	server.current.Store(cfg)
 	server.reaper = grim.ReaperWithContext(cfg.Context)
+	server.conns = newConnTracker()
 	return
 }
 
 // SSHServer handles all the incoming connections as well as handler dispatch.
 type SSHServer struct {
-	config   *Config
-	Addr     *net.TCPAddr
-	listener *net.TCPListener
-	reaper   grim.GrimReaper
+	current   *atomic.Value
+	Addr      []net.Addr
+	listeners []net.Listener
+	reaper    grim.GrimReaper
+	conns     *connTracker
 }
 
-// Start starts accepting client connections. This method is non-blocking.
+// Start starts accepting client connections on every listener. This method is non-blocking.
 func (s *SSHServer) Start() {
-	s.config.Logger.Info("Starting SSH server", "addr", s.config.Bind)
-	s.reaper.SpawnFunc(s.listen)
+	s.currentConfig().Logger.Info("Starting SSH server", "addr", s.Addr)
+	for _, l := range s.listeners {
+		s.conns.listeners.Add(1)
+		s.reaper.SpawnFunc(s.listenFunc(l))
+	}
+
+	// Close the listeners as soon as the server is stopped
+	s.reaper.SpawnFunc(func(c context.Context) {
+		select {
+		case <-c.Done():
+		case <-s.conns.quit:
+		}
+		s.closeListeners()
+	})
+}
+
+// Reload replaces the config of the server. New connections use the host keys,
+// authentication callbacks, Dispatcher, Consumer and per-connection settings of
+// the new config, while existing connections keep the ones they started with. The
+// Logger, GracePeriod and MaxAcceptBackoff of the new config are used by the
+// listeners, Stop and Shutdown from then on. The Context, Bind and Listeners are
+// ignored, since the listeners are already open. The config is validated like in
+// New and must not be modified after it is passed in. If it is invalid an error is
+// returned and the current config is kept.
+func (s *SSHServer) Reload(cfg *Config) error {
+	if err := cfg.prepare(); err != nil {
+		return err
+	}
+	s.current.Store(cfg)
+	cfg.Logger.Info("Reloaded SSH server config")
+	return nil
 }
 
-// Stop stops the server and kills all goroutines. This method is blocking.
+// currentConfig returns the config used for new connections.
+func (s *SSHServer) currentConfig() *Config {
+	return s.current.Load().(*Config)
+}
+
+// Stop stops the server and kills all goroutines. If the config has a GracePeriod,
+// open connections are given that long to drain before being closed. This method is blocking.
 func (s *SSHServer) Stop() {
+	cfg := s.currentConfig()
+	if cfg.GracePeriod > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.GracePeriod)
+		defer cancel()
+		s.Shutdown(ctx)
+		return
+	}
+
 	s.reaper.Kill()
-	s.config.Logger.Info("Shutting down SSH server...")
+	cfg.Logger.Info("Shutting down SSH server...")
 	s.reaper.Wait()
 }
 
-// listen accepts new connections and handles the conversion from TCP to SSH connections.
-func (s *SSHServer) listen(c context.Context) {
-	defer s.listener.Close()
+// Shutdown gracefully stops the server. The listener is closed first, then every
+// connected client is sent a ShutdownRequest and the handlers are notified through
+// DrainNotify. Connections close as soon as their open channels are finished. Any
+// connection still open when the context completes is forcibly closed, in which case
+// the context error is returned. This method is blocking.
+func (s *SSHServer) Shutdown(c context.Context) (stats ShutdownStats, err error) {
+	logger := s.currentConfig().Logger
+	logger.Info("Draining SSH server...")
+
+	// Stop accepting new connections
+	s.conns.stopListening()
+	s.closeListeners()
+	s.conns.listeners.Wait()
+
+	// Notify open connections
+	open := s.conns.open()
+	s.conns.startDraining()
+
+	select {
+	case <-s.conns.wait():
+		stats.Drained = open
+	case <-c.Done():
+		stats.Killed = s.conns.open()
+		stats.Drained = open - stats.Killed
+		err = c.Err()
+	}
+
+	// Kill the stragglers
+	s.reaper.Kill()
+	s.reaper.Wait()
+	logger.Info("SSH server stopped", "drained", stats.Drained, "killed", stats.Killed)
+	return
+}
+
+// Stats returns the current connection and listener counters for the server.
+func (s *SSHServer) Stats() ServerStats {
+	return s.conns.stats()
+}
+
+// closeListeners closes all the listeners, which unblocks any pending Accept calls.
+func (s *SSHServer) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// listenFunc returns a task which accepts connections from the given listener.
+func (s *SSHServer) listenFunc(l net.Listener) grim.TaskFunc {
+	return func(c context.Context) {
+		defer s.conns.listeners.Done()
+		s.listen(c, l)
+	}
+}
+
+// listen accepts new connections and handles the conversion from raw connections to SSH connections.
+func (s *SSHServer) listen(c context.Context, l net.Listener) {
+	defer l.Close()
+
+	// Accept errors are retried with a capped exponential back-off
+	var delay time.Duration
+	var retries int
 
 	for {
-		// Accepts will only block for 1s
-		s.listener.SetDeadline(time.Now().Add(s.config.Deadline))
 
-		select {
+		// Accept new connection
+		conn, err := l.Accept()
+		if err != nil {
+			cfg := s.currentConfig()
 
-		// Stop server on channel receive
-		case <-c.Done():
-			s.config.Logger.Debug("Context Completed")
-			return
-		default:
+			// Stop server once the listener has been closed
+			select {
+			case <-c.Done():
+				cfg.Logger.Debug("Context Completed", "addr", l.Addr())
+				return
+			case <-s.conns.quit:
+				cfg.Logger.Debug("Listener closed", "addr", l.Addr())
+				return
+			default:
+			}
 
-			// Accept new connection
-			tcpConn, err := s.listener.Accept()
-			if err != nil {
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					s.config.Logger.Debug("Connection timeout...")
+			// Back off on temporary errors such as EMFILE
+			s.conns.acceptFailed()
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				if delay == 0 {
+					delay = minAcceptBackoff
 				} else {
-					s.config.Logger.Warn("Connection failed", "error", err)
+					delay *= 2
+				}
+				if max := cfg.maxAcceptBackoff(); delay > max {
+					delay = max
+				}
+				retries++
+				s.conns.backedOff()
+				cfg.Logger.Warn("Accept failed, backing off", "addr", l.Addr(), "error", err, "delay", delay, "retries", retries)
+
+				select {
+				case <-c.Done():
+					return
+				case <-s.conns.quit:
+					return
+				case <-time.After(delay):
 				}
 				continue
 			}
-
-			// Handle connection
-			s.config.Logger.Info("Successful TCP connection:", tcpConn.RemoteAddr().String())
-			s.reaper.Spawn(&tcpHandler{
-				logger:         s.config.Logger,
-				conn:           tcpConn,
-				config:         s.config.sshConfig,
-				dispatcher:     s.config.Dispatcher,
-				requestHandler: s.config.Consumer,
-			})
+			cfg.Logger.Warn("Listener failed", "addr", l.Addr(), "error", err)
+			return
 		}
+		delay = 0
+		retries = 0
+
+		// Handle connection with the current config
+		cfg := s.currentConfig()
+		s.conns.accepted()
+		s.conns.add()
+		s.reaper.Spawn(&tcpHandler{
+			conns:          s.conns,
+			logger:         cfg.Logger,
+			conn:           conn,
+			config:         cfg.sshConfig,
+			dispatcher:     cfg.Dispatcher,
+			requestHandler: cfg.Consumer,
+			timeouts: connTimeouts{
+				handshake:         cfg.HandshakeTimeout,
+				idle:              cfg.IdleTimeout,
+				lifetime:          cfg.MaxLifetime,
+				keepAliveInterval: cfg.KeepAliveInterval,
+				keepAliveCountMax: cfg.KeepAliveCountMax,
+			},
+			proxyProtocol:  cfg.ProxyProtocol,
+			trustedProxies: cfg.trustedProxies,
+			limiter:        cfg.AuthLimiter,
+			limits: connLimits{
+				total:    cfg.MaxConnections,
+				perIP:    cfg.MaxConnectionsPerIP,
+				perUser:  cfg.MaxSessionsPerUser,
+				startups: cfg.MaxStartups,
+			},
+		})
 	}
 }
 
 type tcpHandler struct {
+	conns          *connTracker
 	logger         log.Logger
 	conn           net.Conn
 	config         *ssh.ServerConfig
 	dispatcher     Dispatcher
 	requestHandler RequestConsumer
+	timeouts       connTimeouts
+	proxyProtocol  bool
+	trustedProxies []*net.IPNet
+	limiter        *AuthLimiter
+	limits         connLimits
 }
 
 func (t *tcpHandler) Execute(c context.Context) {
+	defer t.conns.done()
+
 	select {
 	case <-c.Done():
 		t.conn.Close()
@@ -128,52 +303,188 @@ func (t *tcpHandler) Execute(c context.Context) {
 	default:
 	}
 
-	// Create reaper
-	g := grim.ReaperWithContext(c)
-	defer g.Wait()
+	// Close connections which take too long to authenticate
+	var handshakeTimer *time.Timer
+	if timeout := t.timeouts.handshakeTimeout(); timeout > 0 {
+		conn := t.conn
+		handshakeTimer = time.AfterFunc(timeout, func() { conn.Close() })
+		defer handshakeTimer.Stop()
+	}
+
+	// Read the real client address from the PROXY header
+	if t.proxyProtocol && trustedProxy(t.conn.RemoteAddr(), t.trustedProxies) {
+		proxied, err := readProxyHeader(t.conn)
+		if err != nil {
+			t.logger.Warn("PROXY header failed:", "addr", t.conn.RemoteAddr().String(), "error", err)
+			t.conn.Close()
+			return
+		}
+		t.logger.Debug("PROXY header received", "addr", proxied.RemoteAddr().String(), "proxy", t.conn.RemoteAddr().String())
+		t.conn = proxied
+	}
+
+	// Close connections from banned addresses
+	if t.limiter != nil && t.limiter.reject(t.conn.RemoteAddr()) {
+		t.logger.Info("Connection from banned address closed", "addr", t.conn.RemoteAddr().String())
+		t.conn.Close()
+		return
+	}
+
+	// Refuse connections over the limits
+	ip := hostIP(t.conn.RemoteAddr())
+	if reason := t.conns.admit(ip, t.limits); reason != "" {
+		t.logger.Info("Connection refused", "addr", t.conn.RemoteAddr().String(), "reason", reason)
+		refuseConn(t.conn, reason)
+		return
+	}
+	defer t.conns.release(ip)
+	t.logger.Info("Successful connection", "addr", t.conn.RemoteAddr().String())
 
 	// Convert to SSH connection
 	sshConn, channels, requests, err := ssh.NewServerConn(t.conn, t.config)
+	t.conns.handshakeDone()
+	if handshakeTimer != nil && !handshakeTimer.Stop() {
+		err = errors.New("handshake timeout")
+	}
 	if err != nil {
 		t.logger.Warn("SSH handshake failed:", "addr", t.conn.RemoteAddr().String(), "error", err)
+		if sshConn != nil {
+			sshConn.Close()
+		}
 		t.conn.Close()
-		g.Kill()
 		return
 	}
+	t.logger.Debug("Handshake successful", "addr", sshConn.RemoteAddr().String())
+
+	// Refuse users over the session limit
+	if !t.conns.addUser(sshConn.User(), t.limits.perUser) {
+		reason := "too many sessions for " + sshConn.User()
+		t.logger.Info("Connection refused", "addr", sshConn.RemoteAddr().String(), "reason", reason)
+		refuseChannels(c, channels, requests, reason)
+		sshConn.Close()
+		return
+	}
+	defer t.conns.removeUser(sshConn.User())
 
-	// Close connection on exit
-	t.logger.Debug("Handshake successful")
+	// Create reaper for the channel handlers. The connection is owned by this
+	// task rather than by the dispatcher, so it is only closed once the client
+	// disconnects, the idle timeout expires or the server is stopped.
+	g := grim.ReaperWithContext(context.WithValue(c, drainKey{}, t.conns.drain))
+	defer g.Wait()
 	defer sshConn.Close()
-	defer sshConn.Wait()
+	defer g.Kill()
 
 	// Discard all out-of-channel requests
-	if t.requestHandler != nil {
+	if consumer, ok := t.requestHandler.(ConnRequestConsumer); ok {
+		g.SpawnFunc(func(ctx context.Context) {
+			consumer.ConsumeConn(ctx, sshConn, requests)
+		})
+	} else if t.requestHandler != nil {
 		go t.requestHandler.Consume(requests)
 	} else {
 		go ssh.DiscardRequests(requests)
 	}
 
-OUTER:
+	// Each channel handler signals on done when it returns
+	done := make(chan struct{})
+	drain := t.conns.drain
+	var active int
+	var draining bool
+
+	// Close the connection once it has had no channel activity for the
+	// idle timeout
+	activity := newActivity()
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if t.timeouts.idle > 0 {
+		idleTimer = time.NewTimer(t.timeouts.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	// Close the connection once it reaches the max lifetime
+	var lifetime <-chan time.Time
+	if t.timeouts.lifetime > 0 {
+		lifetimeTimer := time.NewTimer(t.timeouts.lifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	// Close the connection once the client stops answering keepalives
+	var dead chan struct{}
+	if t.timeouts.keepAliveInterval > 0 {
+		dead = make(chan struct{})
+		interval, max := t.timeouts.keepAliveInterval, t.timeouts.keepAliveMax()
+		g.SpawnFunc(func(ctx context.Context) {
+			keepAlive(ctx, sshConn, interval, max, dead)
+		})
+	}
+
 	for {
 		select {
 		case <-c.Done():
-			break OUTER
-		case <-g.Dead():
-			break OUTER
-		case ch := <-channels:
+			t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "server stopped")
+			return
+		case <-idle:
+
+			// Wait for the rest of the timeout if there was activity
+			if left := t.timeouts.idle - activity.since(); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "idle timeout")
+			return
+		case <-lifetime:
+			t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "max lifetime")
+			return
+		case <-dead:
+			t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "keepalive timeout")
+			return
+		case <-drain:
+
+			// Stop waiting on the drain channel and tell the client
+			drain = nil
+			draining = true
+			go sshConn.SendRequest(ShutdownRequest, false, nil)
+			if active == 0 {
+				t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "drained")
+				return
+			}
+		case <-done:
+			active--
+			activity.touch()
+			if draining && active == 0 {
+				t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "drained")
+				return
+			}
+		case ch, ok := <-channels:
 
 			// Check if chan was closed
-			if ch == nil {
-				break OUTER
+			if !ok {
+				t.logger.Debug("Closing SSH connection", "addr", sshConn.RemoteAddr().String(), "reason", "client disconnected")
+				return
+			}
+
+			// Refuse new channels while draining
+			if draining {
+				ch.Reject(ssh.ResourceShortage, "server is shutting down")
+				continue
 			}
 
 			// Handle the channel
+			active++
+			activity.touch()
 			g.SpawnFunc(func(ctx context.Context) {
-				t.dispatcher.Dispatch(ctx, sshConn, ch)
-				return
+				defer func() {
+					select {
+					case done <- struct{}{}:
+					case <-ctx.Done():
+					}
+				}()
+				nc := &activeNewChannel{ch, activity, make(chan struct{})}
+				defer close(nc.done)
+				t.dispatcher.Dispatch(ctx, sshConn, nc)
 			})
 		}
 	}
-
-	g.Kill()
 }
@@ -1,9 +1,14 @@
 package sshh
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,6 +16,7 @@ import (
 	"github.com/blacklabeldata/sshh/router"
 	log "github.com/mgutz/logxi/v1"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
@@ -27,7 +33,7 @@ type ServerSuite struct {
 	server *SSHServer
 }
 
-func (suite *ServerSuite) createConfig() Config {
+func (suite *ServerSuite) createConfig() *Config {
 
 	// Create logger
 	writer := log.NewConcurrentWriter(os.Stdout)
@@ -46,7 +52,7 @@ func (suite *ServerSuite) createConfig() Config {
 	r.Register("/bad", &BadHandler{})
 
 	// Create config
-	cfg := Config{
+	cfg := &Config{
 		Context:  context.Background(),
 		Deadline: time.Second,
 		Dispatcher: &UrlDispatcher{
@@ -70,7 +76,7 @@ func (suite *ServerSuite) createConfig() Config {
 func (suite *ServerSuite) SetupTest() {
 
 	cfg := suite.createConfig()
-	server, err := New(&cfg)
+	server, err := New(cfg)
 	if err != nil {
 		suite.Fail("error creating server: " + err.Error())
 	}
@@ -83,6 +89,40 @@ func (suite *ServerSuite) TearDownTest() {
 	suite.server.Stop()
 }
 
+// startServer starts a server on bind which accepts the password "bandit" and
+// routes /echo to an EchoHandler. If configure is not nil, it can change the
+// config before the server is created.
+func startServer(t *testing.T, bind string, configure func(*Config)) *SSHServer {
+
+	// Get signer
+	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+	if err != nil {
+		t.Fatal("Private key could not be parsed", err.Error())
+	}
+
+	r := router.New(log.NullLog, nil, nil)
+	r.Register("/echo", &EchoHandler{log.NullLog})
+
+	cfg := &Config{
+		Context:          context.Background(),
+		Dispatcher:       &UrlDispatcher{Router: r, Logger: log.NullLog},
+		Logger:           log.NullLog,
+		Bind:             bind,
+		PrivateKey:       signer,
+		PasswordCallback: passwordCallback,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal("error creating server", err.Error())
+	}
+	server.Start()
+	return &server
+}
+
 func (suite *ServerSuite) TestClientConnection() {
 
 	// Get signer
@@ -117,6 +157,68 @@ func (suite *ServerSuite) TestClientConnection() {
 	defer channel.Close()
 }
 
+func (suite *ServerSuite) TestMultipleChannels() {
+
+	// Get signer
+	signer, err := ssh.ParsePrivateKey([]byte(clientPrivateKey))
+	if err != nil {
+		suite.Fail("Private key could not be parsed" + err.Error())
+	}
+
+	// Configure client connection
+	config := &ssh.ClientConfig{
+		User: "admin",
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+	}
+
+	// Create client connection
+	client, err := ssh.Dial("tcp", "127.0.0.1:9022", config)
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+	defer client.Close()
+
+	// Open a channel and close it again
+	first, requests, err := client.OpenChannel("/echo", []byte{})
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	first.Close()
+
+	// The connection should still accept new channels
+	second, requests, err := client.OpenChannel("/echo", []byte{})
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer second.Close()
+
+	third, requests, err := client.OpenChannel("/echo", []byte{})
+	if err != nil {
+		suite.Fail(err.Error())
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer third.Close()
+
+	// Both channels should be served concurrently
+	for _, channel := range []ssh.Channel{second, third} {
+		_, err = channel.Write([]byte("hello\n"))
+		suite.Nil(err, "write should succeed")
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(channel, buf)
+		suite.Nil(err, "read should succeed")
+		suite.Equal("hello", string(buf))
+	}
+}
+
 func (suite *ServerSuite) TestUnknownChannel() {
 
 	// Get signer
@@ -170,8 +272,14 @@ func (suite *ServerSuite) TestHandlerError() {
 		suite.Fail(err.Error())
 		return
 	}
-	go ssh.DiscardRequests(requests)
 	defer channel.Close()
+
+	// The error is reported with the exit status
+	req, ok := <-requests
+	if suite.True(ok, "exit status should be sent") {
+		suite.Equal("exit-status", req.Type)
+		suite.Equal([]byte{0, 0, 0, 1}, req.Payload)
+	}
 }
 
 func (suite *ServerSuite) TestUnacceptableChannel() {
@@ -206,7 +314,7 @@ func (suite *ServerSuite) TestUnacceptableChannel() {
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Accept")
 	ch.AssertCalled(suite.T(), "Reject", ChannelAcceptError, "/echo")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
 }
 
 func (suite *ServerSuite) TestInvalidChannelType() {
@@ -239,7 +347,7 @@ func (suite *ServerSuite) TestInvalidChannelType() {
 	// assert that the expectations were met
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Reject", InvalidChannelType, "invalid channel URI")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
 }
 
 func (suite *ServerSuite) TestSchemeNotSupported() {
@@ -269,7 +377,7 @@ func (suite *ServerSuite) TestSchemeNotSupported() {
 	// assert that the expectations were met
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Reject", SchemeNotSupported, "schemes are not supported in the channel URI")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
 }
 
 func (suite *ServerSuite) TestUserNotSupported() {
@@ -329,7 +437,34 @@ func (suite *ServerSuite) TestInvalidQueryParams() {
 	// assert that the expectations were met
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Reject", InvalidQueryParams, "invalid query params in channel type")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
+}
+
+func (suite *ServerSuite) TestParamConstraints() {
+	r := router.New(log.NullLog, nil, nil)
+	err := r.RegisterWith("/db/:id<int>", &EchoHandler{log.New("echo")}, router.Options{
+		Values: map[string]string{"timeout": "duration"},
+	})
+	suite.Nil(err)
+	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
+	serverConn := ssh.ServerConn{Conn: &sshmocks.MockConn{}}
+
+	// Parameters which do not match are unknown channels
+	ch := &sshmocks.MockNewChannel{TypeName: "/db/abc"}
+	ch.On("ChannelType").Return("/db/abc")
+	ch.On("Reject", ssh.UnknownChannelType, "/db/abc").Return(nil)
+	dispatcher.Dispatch(context.Background(), &serverConn, ch)
+	ch.AssertCalled(suite.T(), "Reject", ssh.UnknownChannelType, "/db/abc")
+	ch.AssertNotCalled(suite.T(), "Accept")
+
+	// Query values which do not match are invalid
+	msg := "router: query value 'timeout' is not a valid duration: '10'"
+	ch = &sshmocks.MockNewChannel{TypeName: "/db/1?timeout=10"}
+	ch.On("ChannelType").Return("/db/1?timeout=10")
+	ch.On("Reject", InvalidQueryParams, msg).Return(nil)
+	dispatcher.Dispatch(context.Background(), &serverConn, ch)
+	ch.AssertCalled(suite.T(), "Reject", InvalidQueryParams, msg)
+	ch.AssertNotCalled(suite.T(), "Accept")
 }
 
 func (suite *ServerSuite) TestChannelHandleError() {
@@ -338,8 +473,12 @@ func (suite *ServerSuite) TestChannelHandleError() {
 	r := router.New(log.NullLog, nil, nil)
 	r.Register("/bad", &BadHandler{})
 
-	c := &sshmocks.MockChannel{}
+	stderr := &bytes.Buffer{}
+	c := &sshmocks.MockChannel{StderrReadWriter: stderr}
 	c.On("Close").Return(nil)
+	c.On("CloseWrite").Return(nil)
+	c.On("Stderr").Return(stderr)
+	c.On("SendRequest", "exit-status", false, []byte{0, 0, 0, 1}).Return(false, nil)
 
 	ch := &sshmocks.MockNewChannel{
 		TypeName: channel,
@@ -347,8 +486,6 @@ func (suite *ServerSuite) TestChannelHandleError() {
 	}
 	ch.On("ChannelType").Return(channel)
 	ch.On("Accept").Return(c, nil, nil)
-	ch.On("Reject", ChannelHandleError, "error handling channel: an error occurred").
-		Return(errors.New("error handling channel: an error occurred"))
 
 	conn := &sshmocks.MockConn{}
 	conn.On("Close").Return(nil)
@@ -363,9 +500,131 @@ func (suite *ServerSuite) TestChannelHandleError() {
 	// assert that the expectations were met
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Accept")
-	ch.AssertCalled(suite.T(), "Reject", ChannelHandleError, "error handling channel: an error occurred")
+	ch.AssertNotCalled(suite.T(), "Reject", ChannelHandleError, "error handling channel: an error occurred")
+	suite.Equal("an error occurred\n", stderr.String(), "error should be written to stderr")
+	c.AssertCalled(suite.T(), "SendRequest", "exit-status", false, []byte{0, 0, 0, 1})
+	c.AssertCalled(suite.T(), "CloseWrite")
 	c.AssertCalled(suite.T(), "Close")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
+}
+
+func (suite *ServerSuite) TestManualAccept() {
+
+	// The handler rejects the channel itself
+	r := router.New(log.NullLog, nil, nil)
+	r.Register("/private", router.ManualAccept(router.HandlerFunc(func(ctx *router.UrlContext) error {
+		if string(ctx.ExtraData()) != "secret" {
+			return ctx.Reject(ssh.Prohibited, "not allowed")
+		}
+		return router.AutoAccept(&EchoHandler{log.NullLog}).Handle(ctx)
+	})))
+	r.Register("/bad", router.ManualAccept(router.HandlerFunc(func(ctx *router.UrlContext) error {
+		return errors.New("an error occurred")
+	})))
+
+	ch := &sshmocks.MockNewChannel{TypeName: "/private", ExtData: []byte("guess")}
+	ch.On("ChannelType").Return("/private")
+	ch.On("ExtraData").Return([]byte("guess"))
+	ch.On("Reject", ssh.Prohibited, "not allowed").Return(nil)
+
+	dispatcher := &UrlDispatcher{Logger: log.NullLog, Router: r}
+	dispatcher.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+	ch.AssertNotCalled(suite.T(), "Accept")
+	ch.AssertNumberOfCalls(suite.T(), "Reject", 1)
+
+	// Channels which are not accepted are rejected with the error
+	ch = &sshmocks.MockNewChannel{TypeName: "/bad"}
+	ch.On("ChannelType").Return("/bad")
+	ch.On("Reject", ChannelHandleError, "an error occurred").Return(nil)
+
+	dispatcher.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+	ch.AssertNotCalled(suite.T(), "Accept")
+	ch.AssertCalled(suite.T(), "Reject", ChannelHandleError, "an error occurred")
+
+	// Handlers of the SimpleDispatcher can also reject channels themselves
+	simple := &SimpleDispatcher{Logger: log.NullLog, Handlers: map[string]Handler{
+		"session": ManualAccept(HandlerFunc(func(ctx *Context) error {
+			return ctx.Reject(ssh.ResourceShortage, "busy")
+		})),
+	}}
+	ch = &sshmocks.MockNewChannel{TypeName: "session"}
+	ch.On("ChannelType").Return("session")
+	ch.On("Reject", ssh.ResourceShortage, "busy").Return(nil)
+
+	simple.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+	ch.AssertNotCalled(suite.T(), "Accept")
+	ch.AssertNumberOfCalls(suite.T(), "Reject", 1)
+
+	// Channels can no longer be rejected once accepted
+	c := &sshmocks.MockChannel{}
+	ch = &sshmocks.MockNewChannel{TypeName: "session", Channel: c}
+	ch.On("Accept").Return(c, nil, nil)
+	ctx := &Context{ChannelType: "session", Acceptor: router.Acceptor{NewChannel: ch}}
+	channel, _, err := ctx.Accept()
+	suite.Nil(err)
+	suite.Equal(c, channel)
+	suite.Equal(ErrChannelAccepted, ctx.Reject(ssh.Prohibited, "too late"))
+	ch.AssertNotCalled(suite.T(), "Reject", ssh.Prohibited, "too late")
+}
+
+func (suite *ServerSuite) TestSimpleDispatcherMiddleware() {
+
+	// The middleware rejects the channels the handler would accept
+	var calls []string
+	deny := func(h Handler) Handler {
+		return HandlerFunc(func(ctx *Context) error {
+			calls = append(calls, "deny")
+			return ctx.Reject(ssh.Prohibited, "denied")
+		})
+	}
+	dispatcher := &SimpleDispatcher{
+		Logger: log.NullLog,
+		Handlers: map[string]Handler{
+			"session": HandlerFunc(func(ctx *Context) error {
+				calls = append(calls, "handler")
+				return nil
+			}),
+		},
+	}
+	dispatcher.Use(deny)
+
+	ch := &sshmocks.MockNewChannel{TypeName: "session"}
+	ch.On("ChannelType").Return("session")
+	ch.On("Reject", ssh.Prohibited, "denied").Return(nil)
+	dispatcher.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+
+	suite.Equal([]string{"deny"}, calls)
+	ch.AssertCalled(suite.T(), "Reject", ssh.Prohibited, "denied")
+	ch.AssertNotCalled(suite.T(), "Accept")
+}
+
+func (suite *ServerSuite) TestSimpleDispatcherNotFound() {
+
+	// Unknown channel types go through the middleware to the NotFound handler
+	var calls []string
+	record := func(h Handler) Handler {
+		return HandlerFunc(func(ctx *Context) error {
+			calls = append(calls, "middleware")
+			return h.Handle(ctx)
+		})
+	}
+	dispatcher := &SimpleDispatcher{
+		Logger: log.NullLog,
+		NotFound: ManualAccept(HandlerFunc(func(ctx *Context) error {
+			calls = append(calls, "not found")
+			return ctx.Reject(ssh.UnknownChannelType, "no handler for "+ctx.ChannelType)
+		})),
+	}
+	dispatcher.Use(record)
+
+	ch := &sshmocks.MockNewChannel{TypeName: "x11"}
+	ch.On("ChannelType").Return("x11")
+	ch.On("Reject", ssh.UnknownChannelType, "no handler for x11").Return(nil)
+	dispatcher.Dispatch(context.Background(), &ssh.ServerConn{}, ch)
+
+	suite.Equal([]string{"middleware", "not found"}, calls)
+	ch.AssertCalled(suite.T(), "Reject", ssh.UnknownChannelType, "no handler for x11")
+	ch.AssertNotCalled(suite.T(), "Accept")
 }
 
 func (suite *ServerSuite) TestWildcard() {
@@ -397,5 +656,231 @@ func (suite *ServerSuite) TestWildcard() {
 	// assert that the expectations were met
 	ch.AssertCalled(suite.T(), "ChannelType")
 	ch.AssertCalled(suite.T(), "Reject", ssh.UnknownChannelType, "*")
-	conn.AssertCalled(suite.T(), "Close")
+	conn.AssertNotCalled(suite.T(), "Close")
+}
+
+func TestListeners(t *testing.T) {
+
+	// Get signer
+	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+	if err != nil {
+		t.Fatal("Private key could not be parsed", err.Error())
+	}
+
+	// Create a Unix domain socket and a TCP listener
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "sshh.sock"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	r := router.New(log.NullLog, nil, nil)
+	r.Register("/echo", &EchoHandler{log.NullLog})
+
+	cfg := &Config{
+		Context:          context.Background(),
+		Dispatcher:       &UrlDispatcher{Router: r, Logger: log.NullLog},
+		Logger:           log.NullLog,
+		Listeners:        []net.Listener{unixListener, tcpListener},
+		PrivateKey:       signer,
+		PasswordCallback: passwordCallback,
+	}
+
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal("error creating server", err.Error())
+	}
+	assert.Equal(t, []net.Addr{unixListener.Addr(), tcpListener.Addr()}, server.Addr)
+	server.Start()
+
+	// Both listeners should be served at once
+	for _, addr := range server.Addr {
+		client, err := ssh.Dial(addr.Network(), addr.String(), &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password("bandit"),
+			},
+		})
+		if !assert.Nil(t, err, "client should connect to "+addr.String()) {
+			continue
+		}
+
+		_, requests, err := client.OpenChannel("/echo", []byte{})
+		assert.Nil(t, err, "channel should be accepted")
+		if err == nil {
+			go ssh.DiscardRequests(requests)
+		}
+		client.Close()
+	}
+
+	// Stopping the server should close the listeners right away
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("server should stop without waiting for a deadline")
+	}
+
+	_, err = net.Dial("tcp", tcpListener.Addr().String())
+	assert.NotNil(t, err, "listener should be closed")
+}
+
+// tempError is a temporary net.Error, such as EMFILE.
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// failingListener fails every Accept with a temporary error until it is closed.
+type failingListener struct {
+	closed chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	default:
+		return nil, tempError{}
+	}
+}
+
+func (l *failingListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+
+	// Get signer
+	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+	if err != nil {
+		t.Fatal("Private key could not be parsed", err.Error())
+	}
+
+	listener := &failingListener{make(chan struct{})}
+	cfg := &Config{
+		Context:          context.Background(),
+		Logger:           log.NullLog,
+		PrivateKey:       signer,
+		Listeners:        []net.Listener{listener},
+		MaxAcceptBackoff: 20 * time.Millisecond,
+	}
+
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal("error creating server", err.Error())
+	}
+	server.Start()
+
+	// The delay is capped, so several retries should happen quickly
+	time.Sleep(200 * time.Millisecond)
+	server.Stop()
+
+	stats := server.Stats()
+	assert.True(t, stats.AcceptBackoffs >= 5, "listener should have backed off several times")
+	assert.True(t, stats.AcceptBackoffs <= 40, "listener should not busy-loop")
+	assert.Equal(t, stats.AcceptBackoffs, stats.AcceptErrors, "every error should have been retried")
+	assert.Equal(t, uint64(0), stats.AcceptedConnections, "no connections should have been accepted")
+}
+
+func TestReload(t *testing.T) {
+
+	// Get signer
+	signer, err := ssh.ParsePrivateKey([]byte(serverKey))
+	if err != nil {
+		t.Fatal("Private key could not be parsed", err.Error())
+	}
+
+	r := router.New(log.NullLog, nil, nil)
+	r.Register("/echo", &EchoHandler{log.NullLog})
+
+	cfg := &Config{
+		Context:          context.Background(),
+		Dispatcher:       &UrlDispatcher{Router: r, Logger: log.NullLog},
+		Logger:           log.NullLog,
+		Bind:             "127.0.0.1:9027",
+		PrivateKey:       signer,
+		PasswordCallback: passwordCallback,
+	}
+
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal("error creating server", err.Error())
+	}
+	server.Start()
+	defer server.Stop()
+
+	dial := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", "127.0.0.1:9027", &ssh.ClientConfig{
+			User: "jonny.quest",
+			Auth: []ssh.AuthMethod{
+				ssh.Password(password),
+			},
+		})
+	}
+
+	// Connect with the original config
+	client, err := dial("bandit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	// Invalid configs should be refused
+	err = server.Reload(&Config{Logger: log.NullLog})
+	assert.NotNil(t, err, "config without host keys should not be loaded")
+	err = server.Reload(&Config{Dispatcher: cfg.Dispatcher, PrivateKey: signer})
+	assert.NotNil(t, err, "config without a logger should not be loaded")
+
+	// Change the password
+	err = server.Reload(&Config{
+		Dispatcher: cfg.Dispatcher,
+		Logger:     log.NullLog,
+		PrivateKey: signer,
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "hadji" {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("Invalid username or password")
+		},
+	})
+	assert.Nil(t, err, "config should be reloaded")
+
+	// New connections should use the new config
+	_, err = dial("bandit")
+	assert.NotNil(t, err, "old password should be refused")
+
+	newClient, err := dial("hadji")
+	if assert.Nil(t, err, "new password should be accepted") {
+		newClient.Close()
+	}
+
+	// Existing connections should keep working
+	_, requests, err := client.OpenChannel("/echo", []byte{})
+	if assert.Nil(t, err, "existing connection should still accept channels") {
+		go ssh.DiscardRequests(requests)
+	}
 }
@@ -0,0 +1,158 @@
+package session
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session request types from RFC 4254.
+const (
+	PtyRequest          = "pty-req"
+	EnvRequest          = "env"
+	ShellRequest        = "shell"
+	ExecRequest         = "exec"
+	SubsystemRequest    = "subsystem"
+	WindowChangeRequest = "window-change"
+	SignalRequest       = "signal"
+	ExitStatusRequest   = "exit-status"
+	ExitSignalRequest   = "exit-signal"
+)
+
+// ErrInvalidModes is returned for pty-req requests with malformed terminal modes.
+var ErrInvalidModes = errors.New("session: invalid terminal modes")
+
+// Window is the size of the client terminal.
+type Window struct {
+
+	// Columns and Rows are the size in characters.
+	Columns uint32
+	Rows    uint32
+
+	// Width and Height are the size in pixels, if known.
+	Width  uint32
+	Height uint32
+}
+
+// Pty is a pty-req request for a pseudo-terminal.
+type Pty struct {
+
+	// Term is the TERM environment variable, such as "xterm".
+	Term string
+
+	// Window is the initial size of the terminal.
+	Window Window
+
+	// Modes are the encoded terminal modes, such as ssh.ECHO.
+	Modes ssh.TerminalModes
+}
+
+// Env is an env request to set an environment variable.
+type Env struct {
+	Name  string
+	Value string
+}
+
+// ExitSignal is sent when a command was terminated by a signal.
+type ExitSignal struct {
+	Signal     ssh.Signal
+	CoreDumped bool
+	Message    string
+	Language   string
+}
+
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+type stringRequestMsg struct {
+	Value string
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+// ParsePty parses the payload of a pty-req request.
+func ParsePty(payload []byte) (Pty, error) {
+	var msg ptyRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return Pty{}, err
+	}
+
+	modes, err := parseModes([]byte(msg.Modelist))
+	if err != nil {
+		return Pty{}, err
+	}
+	return Pty{
+		Term:   msg.Term,
+		Window: Window{msg.Columns, msg.Rows, msg.Width, msg.Height},
+		Modes:  modes,
+	}, nil
+}
+
+// ParseWindowChange parses the payload of a window-change request.
+func ParseWindowChange(payload []byte) (Window, error) {
+	var window Window
+	err := ssh.Unmarshal(payload, &window)
+	return window, err
+}
+
+// ParseEnv parses the payload of an env request.
+func ParseEnv(payload []byte) (Env, error) {
+	var msg envRequestMsg
+	err := ssh.Unmarshal(payload, &msg)
+	return Env(msg), err
+}
+
+// ParseExec parses the command of an exec request.
+func ParseExec(payload []byte) (string, error) {
+	return parseString(payload)
+}
+
+// ParseSubsystem parses the name of a subsystem request.
+func ParseSubsystem(payload []byte) (string, error) {
+	return parseString(payload)
+}
+
+// ParseSignal parses the payload of a signal request. The signal name is
+// without the "SIG" prefix, as in ssh.SIGINT.
+func ParseSignal(payload []byte) (ssh.Signal, error) {
+	name, err := parseString(payload)
+	return ssh.Signal(name), err
+}
+
+func parseString(payload []byte) (string, error) {
+	var msg stringRequestMsg
+	err := ssh.Unmarshal(payload, &msg)
+	return msg.Value, err
+}
+
+// parseModes decodes the terminal modes of a pty-req: a list of opcodes each
+// followed by a uint32 argument, ending with TTY_OP_END. Opcodes from 160 on
+// are not defined and stop the parsing, as RFC 4254 requires.
+func parseModes(data []byte) (ssh.TerminalModes, error) {
+	modes := ssh.TerminalModes{}
+	for len(data) > 0 {
+		opcode := data[0]
+		if opcode == 0 || opcode >= 160 {
+			break
+		}
+		if len(data) < 5 {
+			return nil, ErrInvalidModes
+		}
+		modes[opcode] = uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
+		data = data[5:]
+	}
+	return modes, nil
+}
@@ -0,0 +1,60 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePty(t *testing.T) {
+	modes := []byte{ssh.ECHO, 0, 0, 0, 1, ssh.TTY_OP_OSPEED, 0, 0, 0x96, 0, 0}
+	payload := ssh.Marshal(&ptyRequestMsg{"xterm", 80, 24, 640, 480, string(modes)})
+
+	pty, err := ParsePty(payload)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "xterm", pty.Term)
+		assert.Equal(t, Window{80, 24, 640, 480}, pty.Window)
+		assert.Equal(t, ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_OSPEED: 38400}, pty.Modes)
+	}
+
+	// Undefined opcodes stop the parsing
+	payload = ssh.Marshal(&ptyRequestMsg{"vt100", 80, 24, 0, 0, string([]byte{ssh.ECHO, 0, 0, 0, 1, 200, 1})})
+	pty, err = ParsePty(payload)
+	if assert.Nil(t, err) {
+		assert.Equal(t, ssh.TerminalModes{ssh.ECHO: 1}, pty.Modes)
+	}
+
+	payload = ssh.Marshal(&ptyRequestMsg{"vt100", 80, 24, 0, 0, string([]byte{ssh.ECHO, 0, 0})})
+	_, err = ParsePty(payload)
+	assert.Equal(t, ErrInvalidModes, err)
+
+	_, err = ParsePty([]byte{0, 0})
+	assert.NotNil(t, err, "truncated payload should be refused")
+}
+
+func TestParseRequests(t *testing.T) {
+	window, err := ParseWindowChange(ssh.Marshal(&Window{120, 40, 0, 0}))
+	assert.Nil(t, err)
+	assert.Equal(t, Window{120, 40, 0, 0}, window)
+
+	env, err := ParseEnv(ssh.Marshal(&envRequestMsg{"LANG", "en_US.UTF-8"}))
+	assert.Nil(t, err)
+	assert.Equal(t, Env{"LANG", "en_US.UTF-8"}, env)
+
+	// Commands are sent as a single string, spaces included
+	command, err := ParseExec(ssh.Marshal(&stringRequestMsg{"ls -la /tmp"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "ls -la /tmp", command)
+
+	subsystem, err := ParseSubsystem(ssh.Marshal(&stringRequestMsg{"sftp"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "sftp", subsystem)
+
+	sig, err := ParseSignal(ssh.Marshal(&stringRequestMsg{"INT"}))
+	assert.Nil(t, err)
+	assert.Equal(t, ssh.SIGINT, sig)
+
+	_, err = ParseExec([]byte("ls"))
+	assert.NotNil(t, err, "raw command should be refused")
+}
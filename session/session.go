@@ -0,0 +1,267 @@
+// Package session implements the RFC 4254 session channel for sshh handlers.
+// It parses the requests a client sends on a "session" channel, such as
+// pty-req, env, shell and exec, and sends the exit status once the handler
+// is done.
+package session
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/blacklabeldata/sshh/auth"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNotStarted is returned by Start when the channel is closed before the
+// client asked for a shell, command or subsystem.
+var ErrNotStarted = errors.New("session: channel closed before the session started")
+
+// OriginalCommandEnv is set to the command requested by the client when the
+// permissions force another one, as in OpenSSH.
+const OriginalCommandEnv = "SSH_ORIGINAL_COMMAND"
+
+// bufferSize is the number of window changes and signals buffered for handlers
+// which do not read them.
+const bufferSize = 16
+
+// Session is a session channel. Requests are handled in the background: pty-req
+// and env are accepted until the session starts, the first shell, exec or
+// subsystem request starts it, and window-change and signal requests are
+// passed on through WindowChanges and Signals. Any other request is refused.
+type Session struct {
+	ssh.Channel
+
+	perms     *ssh.Permissions
+	mu        sync.Mutex
+	pty       *Pty
+	env       []string
+	kind      string
+	command   string
+	subsystem string
+
+	started chan struct{}
+	closed  chan struct{}
+	windows chan Window
+	signals chan ssh.Signal
+}
+
+// New returns a Session for the accepted channel and starts handling its
+// requests. It enforces the permissions of the connection, ctx.Conn.Permissions
+// for sshh handlers: if they force a command, see auth.ForceCommand, it is run
+// instead of the shell, command or subsystem requested by the client, which can
+// be found in the OriginalCommandEnv. Pseudo-terminals are refused unless
+// auth.PermitPty is permitted, and the auth.Environment is added to the
+// Environ. Nil permissions allow everything.
+func New(channel ssh.Channel, requests <-chan *ssh.Request, perms *ssh.Permissions) *Session {
+	s := &Session{
+		Channel: channel,
+		perms:   perms,
+		started: make(chan struct{}),
+		closed:  make(chan struct{}),
+		windows: make(chan Window, bufferSize),
+		signals: make(chan ssh.Signal, bufferSize),
+	}
+	go s.handleRequests(requests)
+	return s
+}
+
+// Start waits until the client asks for a shell, command or subsystem.
+func (s *Session) Start() error {
+	select {
+	case <-s.started:
+		return nil
+	case <-s.closed:
+
+		// The session may have started just before the channel closed
+		select {
+		case <-s.started:
+			return nil
+		default:
+		}
+		return ErrNotStarted
+	}
+}
+
+// Type returns the request which started the session: ShellRequest,
+// ExecRequest or SubsystemRequest. It is empty until the session starts.
+func (s *Session) Type() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kind
+}
+
+// Pty returns the pseudo-terminal requested by the client, if any.
+func (s *Session) Pty() (Pty, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pty == nil {
+		return Pty{}, false
+	}
+	return *s.pty, true
+}
+
+// Environ returns the environment variables set by the client as NAME=value,
+// followed by the ones set by the permissions, which take precedence.
+func (s *Session) Environ() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env := append([]string(nil), s.env...)
+	return append(env, auth.Environment(s.perms)...)
+}
+
+// Command returns the command of an exec request. It is empty for shells.
+func (s *Session) Command() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.command
+}
+
+// Subsystem returns the name of the subsystem requested, such as "sftp".
+func (s *Session) Subsystem() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subsystem
+}
+
+// WindowChanges receives the new terminal size whenever the client resizes
+// it. If the handler falls behind, the oldest sizes are dropped. The channel
+// is closed once the client stops sending requests.
+func (s *Session) WindowChanges() <-chan Window {
+	return s.windows
+}
+
+// Signals receives the signals sent by the client. If the handler falls
+// behind, further signals are dropped. The channel is closed once the client
+// stops sending requests.
+func (s *Session) Signals() <-chan ssh.Signal {
+	return s.signals
+}
+
+// Exit sends the exit status of the command, then closes the channel.
+func (s *Session) Exit(code int) error {
+	return Exit(s.Channel, code)
+}
+
+// ExitWithSignal reports that the command was terminated by a signal, then
+// closes the channel.
+func (s *Session) ExitWithSignal(sig ExitSignal) error {
+	return ExitWithSignal(s.Channel, sig)
+}
+
+// handleRequests replies to the requests until the channel is closed.
+func (s *Session) handleRequests(requests <-chan *ssh.Request) {
+	defer close(s.signals)
+	defer close(s.windows)
+	defer close(s.closed)
+
+	for req := range requests {
+		ok := s.handle(req)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// handle records a request and returns true if it was accepted.
+func (s *Session) handle(req *ssh.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := s.kind != ""
+
+	switch req.Type {
+	case PtyRequest:
+		pty, err := ParsePty(req.Payload)
+		if err != nil || started || s.pty != nil || !auth.Permitted(s.perms, auth.PermitPty) {
+			return false
+		}
+		s.pty = &pty
+	case EnvRequest:
+		env, err := ParseEnv(req.Payload)
+		if err != nil || started {
+			return false
+		}
+		s.env = append(s.env, env.Name+"="+env.Value)
+	case ShellRequest:
+		if started {
+			return false
+		}
+		s.start(ShellRequest, "", "")
+	case ExecRequest:
+		command, err := ParseExec(req.Payload)
+		if err != nil || started {
+			return false
+		}
+		s.start(ExecRequest, command, "")
+	case SubsystemRequest:
+		subsystem, err := ParseSubsystem(req.Payload)
+		if err != nil || started {
+			return false
+		}
+		s.start(SubsystemRequest, "", subsystem)
+	case WindowChangeRequest:
+		window, err := ParseWindowChange(req.Payload)
+		if err != nil {
+			return false
+		}
+		for {
+			select {
+			case s.windows <- window:
+				return true
+			default:
+			}
+
+			// Drop the oldest size to make room
+			select {
+			case <-s.windows:
+			default:
+			}
+		}
+	case SignalRequest:
+		sig, err := ParseSignal(req.Payload)
+		if err != nil {
+			return false
+		}
+		select {
+		case s.signals <- sig:
+		default:
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// start starts the session with the request of the client, or with the forced
+// command if there is one.
+func (s *Session) start(kind, command, subsystem string) {
+	if forced, ok := auth.ForceCommand(s.perms); ok {
+		if kind == ExecRequest {
+			s.env = append(s.env, OriginalCommandEnv+"="+command)
+		}
+		kind, command, subsystem = ExecRequest, forced, ""
+	}
+	s.kind, s.command, s.subsystem = kind, command, subsystem
+	close(s.started)
+}
+
+// Exit sends the exit status of a command on a session channel, then sends EOF
+// and closes the channel.
+func Exit(channel ssh.Channel, code int) error {
+	_, err := channel.SendRequest(ExitStatusRequest, false, ssh.Marshal(&exitStatusMsg{uint32(code)}))
+	return closeChannel(channel, err)
+}
+
+// ExitWithSignal reports that a command was terminated by a signal on a
+// session channel, then sends EOF and closes the channel.
+func ExitWithSignal(channel ssh.Channel, sig ExitSignal) error {
+	_, err := channel.SendRequest(ExitSignalRequest, false, ssh.Marshal(&sig))
+	return closeChannel(channel, err)
+}
+
+func closeChannel(channel ssh.Channel, err error) error {
+	channel.CloseWrite()
+	if cerr := channel.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,283 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blacklabeldata/sshh/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signer
+}
+
+// connect returns a client connected to a server which passes every session
+// channel to the handler.
+func connect(t *testing.T, handler func(*Session)) *ssh.Client {
+	return connectWith(t, &ssh.ServerConfig{NoClientAuth: true}, &ssh.ClientConfig{User: "jonny"}, handler)
+}
+
+// connectWith is like connect with the given configs. The sessions enforce the
+// permissions of the connection.
+func connectWith(t *testing.T, config *ssh.ServerConfig, clientConfig *ssh.ClientConfig, handler func(*Session)) *ssh.Client {
+	config.AddHostKey(newSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		for ch := range channels {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go handler(New(channel, reqs, serverConn.Permissions))
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return client
+}
+
+func TestSessionExec(t *testing.T) {
+	result := make(chan *Session, 1)
+	client := connect(t, func(s *Session) {
+		if err := s.Start(); err != nil {
+			return
+		}
+		result <- s
+		s.Write([]byte(s.Command()))
+		s.Exit(3)
+	})
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.Nil(t, sess.Setenv("LANG", "C"))
+	assert.Nil(t, sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{ssh.ECHO: 0}))
+
+	out, err := sess.Output("echo hello world")
+	assert.Equal(t, "echo hello world", string(out))
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, "exit status should be sent") {
+		assert.Equal(t, 3, exit.ExitStatus())
+	}
+
+	s := <-result
+	assert.Equal(t, ExecRequest, s.Type())
+	assert.Equal(t, []string{"LANG=C"}, s.Environ())
+	if pty, ok := s.Pty(); assert.True(t, ok, "pty should be recorded") {
+		assert.Equal(t, "xterm", pty.Term)
+		assert.Equal(t, Window{80, 24, 640, 192}, pty.Window)
+		assert.Equal(t, ssh.TerminalModes{ssh.ECHO: 0}, pty.Modes)
+	}
+}
+
+func TestSessionShell(t *testing.T) {
+	windows := make(chan Window, 1)
+	signals := make(chan ssh.Signal, 1)
+	client := connect(t, func(s *Session) {
+		if err := s.Start(); err != nil {
+			return
+		}
+		windows <- <-s.WindowChanges()
+		signals <- <-s.Signals()
+		s.ExitWithSignal(ExitSignal{Signal: ssh.SIGTERM, Message: "terminated"})
+	})
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.Nil(t, sess.Shell())
+	assert.NotNil(t, sess.Setenv("LANG", "C"), "env after the start should be refused")
+
+	_, err = sess.SendRequest(WindowChangeRequest, false, ssh.Marshal(&Window{100, 50, 0, 0}))
+	assert.Nil(t, err)
+	assert.Nil(t, sess.Signal(ssh.SIGINT))
+
+	select {
+	case window := <-windows:
+		assert.Equal(t, Window{100, 50, 0, 0}, window)
+	case <-time.After(time.Second):
+		t.Fatal("window change should be received")
+	}
+	assert.Equal(t, ssh.SIGINT, <-signals)
+
+	err = sess.Wait()
+	if exit, ok := err.(*ssh.ExitError); assert.True(t, ok, "exit signal should be sent") {
+		assert.Equal(t, "TERM", exit.Signal())
+		assert.Equal(t, "terminated", exit.Msg())
+	}
+}
+
+func TestSessionNotStarted(t *testing.T) {
+	result := make(chan error, 1)
+	client := connect(t, func(s *Session) {
+		result <- s.Start()
+	})
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ok, err := sess.SendRequest("x11-req", true, nil)
+	assert.Nil(t, err)
+	assert.False(t, ok, "unknown requests should be refused")
+	sess.Close()
+
+	assert.Equal(t, ErrNotStarted, <-result)
+}
+
+func TestSessionForceCommand(t *testing.T) {
+	ca, user := newSigner(t), newSigner(t)
+	cert := &ssh.Certificate{
+		Key:             user.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"jonny"},
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{auth.ForceCommandOption: "backup"},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := ssh.NewCertSigner(cert, user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	result := make(chan *Session, 2)
+	authority := &auth.CertAuthority{Authorities: []ssh.PublicKey{ca.PublicKey()}}
+	client := connectWith(t, &ssh.ServerConfig{PublicKeyCallback: authority.Authenticate}, &ssh.ClientConfig{
+		User: "jonny",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}, func(s *Session) {
+		if err := s.Start(); err != nil {
+			return
+		}
+		result <- s
+		s.Exit(0)
+	})
+	defer client.Close()
+
+	// Commands are replaced by the forced one
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.Nil(t, sess.Run("rm -rf /"))
+	s := <-result
+	assert.Equal(t, ExecRequest, s.Type())
+	assert.Equal(t, "backup", s.Command())
+	assert.Equal(t, []string{OriginalCommandEnv + "=rm -rf /"}, s.Environ())
+
+	// So are shells
+	sess, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.Nil(t, sess.Shell())
+	sess.Wait()
+	s = <-result
+	assert.Equal(t, ExecRequest, s.Type())
+	assert.Equal(t, "backup", s.Command())
+}
+
+func TestSessionRestrictedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authorized_keys")
+
+	restricted, forced := newSigner(t), newSigner(t)
+	data := `no-pty,environment="TZ=UTC",environment="LANG=C" ` + string(ssh.MarshalAuthorizedKey(restricted.PublicKey())) +
+		`command="backup" ` + string(ssh.MarshalAuthorizedKey(forced.PublicKey()))
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	keys := &auth.AuthorizedKeys{Path: path}
+
+	result := make(chan *Session, 1)
+	handler := func(s *Session) {
+		if err := s.Start(); err != nil {
+			return
+		}
+		result <- s
+		s.Exit(0)
+	}
+	dial := func(signer ssh.Signer) *ssh.Client {
+		return connectWith(t, &ssh.ServerConfig{PublicKeyCallback: keys.Authenticate}, &ssh.ClientConfig{
+			User: "jonny",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		}, handler)
+	}
+
+	// no-pty refuses pseudo-terminals and environment= is added to the
+	// client environment, overriding it
+	client := dial(restricted)
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.NotNil(t, sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}), "pty should be refused")
+	assert.Nil(t, sess.Setenv("LANG", "en_US"))
+	assert.Nil(t, sess.Run("date"))
+	s := <-result
+	_, ok := s.Pty()
+	assert.False(t, ok, "pty should not be recorded")
+	assert.Equal(t, "date", s.Command())
+	assert.Equal(t, []string{"LANG=en_US", "TZ=UTC", "LANG=C"}, s.Environ())
+	client.Close()
+
+	// command= replaces the command
+	client = dial(forced)
+	sess, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.Nil(t, sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}), "pty should be allowed")
+	assert.Nil(t, sess.Run("cat /etc/shadow"))
+	s = <-result
+	assert.Equal(t, "backup", s.Command())
+	assert.Equal(t, []string{OriginalCommandEnv + "=cat /etc/shadow"}, s.Environ())
+	client.Close()
+}
@@ -0,0 +1,190 @@
+package sshh
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+const (
+	// KeepAliveRequest is the global request sent to check that the client
+	// is still there. Clients reply to it even though they do not know it.
+	KeepAliveRequest = "keepalive@openssh.com"
+
+	// defaultHandshakeTimeout is the handshake timeout used if none is
+	// set, the same as the OpenSSH LoginGraceTime.
+	defaultHandshakeTimeout = 2 * time.Minute
+
+	// defaultKeepAliveCountMax is the number of unanswered keepalives
+	// which close the connection if none is set.
+	defaultKeepAliveCountMax = 3
+)
+
+// connTimeouts are the timeouts from the Config.
+type connTimeouts struct {
+	handshake         time.Duration
+	idle              time.Duration
+	lifetime          time.Duration
+	keepAliveInterval time.Duration
+	keepAliveCountMax int
+}
+
+// handshakeTimeout returns the handshake timeout, or zero if it is disabled.
+func (t connTimeouts) handshakeTimeout() time.Duration {
+	switch {
+	case t.handshake < 0:
+		return 0
+	case t.handshake == 0:
+		return defaultHandshakeTimeout
+	}
+	return t.handshake
+}
+
+func (t connTimeouts) keepAliveMax() int {
+	if t.keepAliveCountMax <= 0 {
+		return defaultKeepAliveCountMax
+	}
+	return t.keepAliveCountMax
+}
+
+// activity records when a connection last had channel activity.
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+// touch records activity now.
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// since returns the time since the last activity.
+func (a *activity) since() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&a.last))
+}
+
+// requests forwards the channel requests, recording each one as activity.
+// Once done is closed, the requests which are not read are discarded.
+func (a *activity) requests(in <-chan *ssh.Request, done <-chan struct{}) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			a.touch()
+			select {
+			case out <- req:
+			case <-done:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				ssh.DiscardRequests(in)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// activeNewChannel records the activity on the channel once accepted. Done is
+// closed once the channel is dispatched.
+type activeNewChannel struct {
+	ssh.NewChannel
+	activity *activity
+	done     chan struct{}
+}
+
+func (n *activeNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := n.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	return &activeChannel{ch, n.activity}, n.activity.requests(reqs, n.done), nil
+}
+
+// activeChannel records reads and writes as activity.
+type activeChannel struct {
+	ssh.Channel
+	activity *activity
+}
+
+func (c *activeChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	if n > 0 {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+func (c *activeChannel) Write(data []byte) (int, error) {
+	c.activity.touch()
+	return c.Channel.Write(data)
+}
+
+func (c *activeChannel) Stderr() io.ReadWriter {
+	return &activeReadWriter{c.Channel.Stderr(), c.activity}
+}
+
+// activeReadWriter records reads and writes of the extended data as activity.
+type activeReadWriter struct {
+	io.ReadWriter
+	activity *activity
+}
+
+func (rw *activeReadWriter) Read(data []byte) (int, error) {
+	n, err := rw.ReadWriter.Read(data)
+	if n > 0 {
+		rw.activity.touch()
+	}
+	return n, err
+}
+
+func (rw *activeReadWriter) Write(data []byte) (int, error) {
+	rw.activity.touch()
+	return rw.ReadWriter.Write(data)
+}
+
+// keepAlive sends a keepalive request every interval and closes dead once max
+// requests in a row have gone unanswered. Only one request is outstanding at
+// a time.
+func keepAlive(c context.Context, conn ssh.Conn, interval time.Duration, max int, dead chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	var pending bool
+	var missed int
+	for {
+		select {
+		case <-c.Done():
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				if missed++; missed >= max {
+					close(dead)
+					return
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest(KeepAliveRequest, true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package sshh
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// closedWithin returns true if the client connection is closed in time.
+func closedWithin(client *ssh.Client, d time.Duration) bool {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := startServer(t, "127.0.0.1:9030", func(cfg *Config) {
+		cfg.HandshakeTimeout = 100 * time.Millisecond
+	})
+	defer server.Stop()
+
+	// A client which never speaks is disconnected
+	conn, err := net.Dial("tcp", "127.0.0.1:9030")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(ioutil.Discard, conn)
+	assert.Nil(t, err, "connection should be closed by the server")
+	assert.True(t, time.Since(start) < 2*time.Second, "connection should be closed after the timeout")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := startServer(t, "127.0.0.1:9031", func(cfg *Config) {
+		cfg.IdleTimeout = 200 * time.Millisecond
+	})
+	defer server.Stop()
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:9031", &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	channel, _, err := client.OpenChannel("/echo", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Channel activity keeps the connection open
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err = channel.Write([]byte("ping\n"))
+		assert.Nil(t, err, "connection should be open while active")
+	}
+
+	// An open channel without activity does not
+	assert.True(t, closedWithin(client, 2*time.Second), "idle connection should be closed")
+}
+
+func TestMaxLifetime(t *testing.T) {
+	server := startServer(t, "127.0.0.1:9032", func(cfg *Config) {
+		cfg.MaxLifetime = 300 * time.Millisecond
+		cfg.KeepAliveInterval = 50 * time.Millisecond
+	})
+	defer server.Stop()
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:9032", &ssh.ClientConfig{
+		User: "jonny.quest",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("bandit"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	// Keepalives are answered by the client, so only the lifetime applies
+	assert.False(t, closedWithin(client, 200*time.Millisecond), "connection should be open")
+	assert.True(t, closedWithin(client, 2*time.Second), "connection should be closed after its lifetime")
+}
+
+// silentConn never answers requests.
+type silentConn struct {
+	ssh.Conn
+	sent   chan string
+	closed chan struct{}
+}
+
+func (c *silentConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	c.sent <- name
+	<-c.closed
+	return false, nil, errors.New("closed")
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn := &silentConn{sent: make(chan string, 10), closed: make(chan struct{})}
+	defer close(conn.closed)
+
+	dead := make(chan struct{})
+	go keepAlive(context.Background(), conn, 10*time.Millisecond, 3, dead)
+
+	select {
+	case <-dead:
+	case <-time.After(time.Second):
+		t.Fatal("unanswered keepalives should close the connection")
+	}
+	assert.Equal(t, KeepAliveRequest, <-conn.sent)
+	assert.Len(t, conn.sent, 0, "only one keepalive should be outstanding")
+}
+
+func TestActivityRequests(t *testing.T) {
+	in := make(chan *ssh.Request)
+	done := make(chan struct{})
+	out := newActivity().requests(in, done)
+
+	// Requests are forwarded until the channel is dispatched
+	in <- &ssh.Request{Type: "env"}
+	assert.Equal(t, "env", (<-out).Type)
+
+	// Unread requests are then discarded, not left blocking
+	close(done)
+	sent := make(chan struct{})
+	go func() {
+		in <- &ssh.Request{Type: "env"}
+		in <- &ssh.Request{Type: "env"}
+		close(in)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("requests should be discarded once the channel is dispatched")
+	}
+}